@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -35,8 +36,31 @@ func (c *Command) Help() string {
 
         -server=127.0.0.1:8500 HTTP address of a Consul agent in the cluster
         -config-dir=/etc/depro/
-        -config-file=/etc/depro/myapp.json
+        -config-file=/etc/depro/myapp.json (.json, .hcl, .yaml or .yml)
+        -grace-period=30s      Time to wait for running tasks when shutting down
+        -control-addr=127.0.0.1:8510 Address of the agent's control endpoint
+        -config-kv=depro/roles/web Key prefix in Consul to read deployments from
 		-auth=username:password
+        -token-file=/etc/depro/token Read the Consul token from a file
+        -consistency=stale     Consistency of reads: stale, default or consistent
+        -scheme=https          Connect to Consul over TLS
+        -ca-file=/etc/depro/ca.pem
+        -cert-file=/etc/depro/client.pem -key-file=/etc/depro/client-key.pem
+
+    Reloading:
+
+        Sending the agent a SIGHUP, or a POST request to /v1/reload on its
+        control endpoint, will reload its configuration files. Deployments
+        are started, stopped or updated to match the new configuration, which
+        is rejected if it is invalid. Configuration is also reloaded whenever
+        the keys beneath -config-kv change.
+
+    Exit Codes:
+
+        0 The agent was shut down cleanly
+        1 The configuration could not be loaded
+        2 One or more deployments crashed
+        3 Running tasks did not complete within the grace period
     `
 
 	return strings.TrimSpace(helpText)
@@ -45,29 +69,106 @@ func (c *Command) Help() string {
 // Run executes the deployment command
 func (c *Command) Run(args []string) int {
 	c.args = args
-	err := c.setupConfig()
+	err := c.setupConfig(context.Background())
 	if err != nil {
 		c.UI.Error(err.Error())
 		return 1
 	}
 
+	err = c.config.Validate()
+	if err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+
+	// Deployments create their own clients, so problems with the connection
+	// settings are reported before any of them are started.
+	if _, err := c.config.GetAPIClient(); err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+
+	ctx, forceCh, stop := util.ShutdownContext(context.Background())
+	defer stop()
+
+	// exited is closed before stop cancels the context, so that the agent
+	// only reports shutting down when it was asked to by a signal.
+	exited := make(chan struct{})
+	defer close(exited)
+
 	go func() {
 		select {
-		case <-util.MakeShutdownCh():
-			c.UI.Info("Shutting down agents, waiting for inflight requests and running tasks to complete.")
+		case <-ctx.Done():
+		case <-exited:
+			return
 		}
 
 		select {
-		case <-util.MakeShutdownCh():
-			c.UI.Info("Forcing inflight requests to complete and exiting running tasks.")
-			os.Exit(1)
+		case <-exited:
+			return
+		default:
 		}
+
+		c.UI.Info("Shutting down agents, waiting for inflight requests and running tasks to complete.")
+
+		select {
+		case <-forceCh:
+		case <-exited:
+			return
+		}
+
+		c.UI.Info("Forcing inflight requests to complete and exiting running tasks.")
+		os.Exit(3)
 	}()
 
 	agent := NewOperation(c.UI, c.config)
 
-	err = agent.Run()
-	if err != nil {
+	reload := func() error {
+		config, err := c.loadConfig(ctx)
+		if err == nil {
+			err = agent.Reload(config)
+		}
+
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Failed to reload configuration, keeping the current configuration: %s", err))
+			return err
+		}
+
+		c.UI.Info("Configuration reloaded")
+		return nil
+	}
+
+	go func() {
+		for range util.MakeReloadCh(ctx) {
+			reload()
+		}
+	}()
+
+	go WatchConfigKV(ctx, c.UI, c.config, func() {
+		c.UI.Info(fmt.Sprintf("Deployments in '%s' changed, reloading configuration", c.config.ConfigKV))
+		reload()
+	})
+
+	if c.config.ControlAddr != "" {
+		control, err := NewControlServer(c.config.ControlAddr, reload)
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Failed to start control endpoint: %s", err))
+			return 1
+		}
+
+		go func() {
+			err := control.Run(ctx)
+			if err != nil {
+				c.UI.Error(fmt.Sprintf("Control endpoint stopped: %s", err))
+			}
+		}()
+	}
+
+	err = agent.Run(ctx)
+	if err == ErrGracePeriodExceeded {
+		c.UI.Error(fmt.Sprintf("Failed to stop agent: %s", err.Error()))
+		return 3
+	} else if err != nil {
 		c.UI.Error(fmt.Sprintf("Failed to run agent: %s", err.Error()))
 		return 2
 	}
@@ -75,17 +176,33 @@ func (c *Command) Run(args []string) int {
 	return 0
 }
 
-func (c *Command) setupConfig() error {
-	c.config = DefaultConfig()
+func (c *Command) setupConfig(ctx context.Context) error {
+	config, err := c.loadConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.config = config
+	return nil
+}
+
+// loadConfig reads the agent's configuration from its flags, configuration
+// files and configuration keys.
+func (c *Command) loadConfig(ctx context.Context) (*Config, error) {
+	config := DefaultConfig()
 
 	cmdFlags := flag.NewFlagSet("agent", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.UI.Output(c.Help()) }
 
-	if err := ParseFlags(c.config, c.args, cmdFlags); err != nil {
-		return err
+	if err := ParseFlags(config, c.args, cmdFlags); err != nil {
+		return nil, err
 	}
 
-	return nil
+	if err := LoadConfigKV(ctx, config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
 }
 
 func init() {
@@ -1,16 +1,20 @@
 package agent
 
 import (
-	"encoding/json"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/EMSSConsulting/Depro/common"
+	"github.com/EMSSConsulting/Depro/ordering"
+	"github.com/EMSSConsulting/Depro/states"
 	"github.com/EMSSConsulting/Depro/util"
 )
 
@@ -22,11 +26,36 @@ type Config struct {
 
 	Name        string             `json:"name"`
 	Deployments []DeploymentConfig `json:"deployments"`
+
+	// Templates are named sets of defaults which deployments may extend.
+	Templates map[string]DeploymentConfig `json:"templates"`
+
+	// GracePeriod is the amount of time the agent will wait for running
+	// scripts to complete and sessions to be released once a shutdown
+	// has been requested.
+	GracePeriod    time.Duration `json:"-"`
+	GracePeriodRaw string        `json:"gracePeriod"`
+
+	// ControlAddr is the address on which the agent's control endpoint
+	// listens, it is disabled if left empty.
+	ControlAddr string `json:"controlAddr"`
+
+	// Tags describe the agent to the selectors of versions, which are only
+	// deployed by agents whose tags match them.
+	Tags map[string]string `json:"tags"`
+
+	// ConfigKV is a key prefix in Consul beneath which each key holds the
+	// configuration of a deployment to run alongside those in files.
+	ConfigKV string `json:"configKV"`
 }
 
 // Deployment describes an individual deployment including the key prefix
 // and scripts which should be executed to run the deployment.
 type DeploymentConfig struct {
+	// Extends is the name of the template providing defaults for any values
+	// which the deployment does not set itself.
+	Extends string `json:"extends"`
+
 	ID      string   `json:"id"`
 	Path    string   `json:"path"`
 	Prefix  string   `json:"prefix"`
@@ -34,18 +63,182 @@ type DeploymentConfig struct {
 	Deploy  []string `json:"deploy"`
 	Rollout []string `json:"rollout"`
 	Clean   []string `json:"clean"`
+
+	// Hooks run before and after the deployment's scripts, or once any of
+	// them have failed.
+	PreDeploy   *HookConfig `json:"preDeploy"`
+	PostDeploy  *HookConfig `json:"postDeploy"`
+	PreRollout  *HookConfig `json:"preRollout"`
+	PostRollout *HookConfig `json:"postRollout"`
+	PreClean    *HookConfig `json:"preClean"`
+	OnFailure   *HookConfig `json:"onFailure"`
+
+	// Ordering decides which of the deployment's versions are newest, which
+	// are deployed first when several are waiting, see the ordering package.
+	Ordering string `json:"ordering"`
+
+	// Owner and Group own the deployment's version directories and the files
+	// which the agent writes into its path, which are otherwise owned by the
+	// agent's user. DirMode and FileMode are their permissions, written in
+	// octal, which are 0755 and 0644 by default.
+	Owner    string `json:"owner"`
+	Group    string `json:"group"`
+	DirMode  string `json:"dirMode"`
+	FileMode string `json:"fileMode"`
+
+	// User runs the deployment's scripts as another user, rather than as the
+	// agent's own user. It is only supported with the sh and bash shells.
+	User string `json:"user"`
+
+	// VersionPattern is the regular expression which version IDs must match
+	// to be deployed, states.DefaultVersionPattern when it is empty.
+	VersionPattern string `json:"versionPattern"`
+
+	// Consul overrides the agent's connection to Consul for the deployment.
+	Consul *ConsulConfig `json:"consul"`
+
+	// source and index locate the deployment within its configuration file,
+	// index is -1 when the deployment makes up the whole of its source.
+	source string
+	index  int
+
+	// set holds the names of the values which were set in the deployment's
+	// source, which are never replaced by those of its template.
+	set map[string]struct{}
+}
+
+// File returns the path of the configuration file in which the deployment
+// was defined.
+func (d *DeploymentConfig) File() string {
+	return d.source
+}
+
+// ConsulConfig describes a connection to Consul, any values which are left
+// unset are taken from the agent's configuration.
+type ConsulConfig struct {
+	Server             string `json:"server"`
+	Token              string `json:"token"`
+	TokenFile          string `json:"tokenFile"`
+	CredentialsFile    string `json:"credentialsFile"`
+	Datacenter         string `json:"datacenter"`
+	Scheme             string `json:"scheme"`
+	CAFile             string `json:"caFile"`
+	CAPath             string `json:"caPath"`
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	TLSServerName      string `json:"tlsServerName"`
+	InsecureSkipVerify *bool  `json:"insecureSkipVerify"`
+}
+
+// ClientConfig returns the configuration used to connect to Consul for the
+// deployment, which is the agent's configuration with the deployment's
+// overrides applied to it.
+func (d *DeploymentConfig) ClientConfig(agent *common.Config) *common.Config {
+	config := *agent
+	if d.Consul == nil {
+		return &config
+	}
+
+	overrides := []struct {
+		target *string
+		value  string
+	}{
+		{&config.Server, d.Consul.Server},
+		{&config.Token, d.Consul.Token},
+		{&config.TokenFile, d.Consul.TokenFile},
+		{&config.CredentialsFile, d.Consul.CredentialsFile},
+		{&config.Datacenter, d.Consul.Datacenter},
+		{&config.Scheme, d.Consul.Scheme},
+		{&config.CAFile, d.Consul.CAFile},
+		{&config.CAPath, d.Consul.CAPath},
+		{&config.CertFile, d.Consul.CertFile},
+		{&config.KeyFile, d.Consul.KeyFile},
+		{&config.TLSServerName, d.Consul.TLSServerName},
+	}
+
+	// A deployment's own token replaces the agent's token file.
+	if d.Consul.Token != "" {
+		config.TokenFile = ""
+	}
+
+	for _, override := range overrides {
+		if override.value != "" {
+			*override.target = override.value
+		}
+	}
+
+	if d.Consul.InsecureSkipVerify != nil {
+		config.InsecureSkipVerify = *d.Consul.InsecureSkipVerify
+	}
+
+	return &config
+}
+
+// field returns the name of one of the deployment's fields within its source,
+// given the deployment's position in the merged configuration.
+func (d *DeploymentConfig) field(position int, name string) string {
+	if d.source == "" {
+		return fmt.Sprintf("deployments[%d].%s", position, name)
+	}
+
+	if d.index < 0 {
+		return name
+	}
+
+	return fmt.Sprintf("deployments[%d].%s", d.index, name)
 }
 
+// knownShells are the shells which may be used to run a deployment's scripts,
+// an empty shell selects the platform's default.
+var knownShells = []string{"", "sh", "bash", "cmd", "powershell"}
+
 // Merge the second command entry into the first and return a reference
 // to the first.
 func Merge(a, b *Config) {
 	common.Merge(&a.Config, &b.Config)
 
-	if b.Name != "" {
+	if b.Name != "" || b.IsSet("name") {
 		a.Name = b.Name
+		a.MergeSource(&b.Config, "name")
+	}
+
+	if b.GracePeriod != 0 || b.IsSet("gracePeriod") {
+		a.GracePeriod = b.GracePeriod
+		a.GracePeriodRaw = b.GracePeriodRaw
+		a.MergeSource(&b.Config, "gracePeriod")
+	}
+
+	if b.ControlAddr != "" || b.IsSet("controlAddr") {
+		a.ControlAddr = b.ControlAddr
+		a.MergeSource(&b.Config, "controlAddr")
+	}
+
+	if b.ConfigKV != "" || b.IsSet("configKV") {
+		a.ConfigKV = b.ConfigKV
+		a.MergeSource(&b.Config, "configKV")
+	}
+
+	if len(b.Tags) > 0 && a.Tags == nil {
+		a.Tags = map[string]string{}
+	}
+
+	for key, value := range b.Tags {
+		a.Tags[key] = value
+	}
+
+	if len(b.Tags) > 0 {
+		a.MergeSource(&b.Config, "tags")
 	}
 
 	a.Deployments = append(a.Deployments, b.Deployments...)
+
+	if len(b.Templates) > 0 && a.Templates == nil {
+		a.Templates = map[string]DeploymentConfig{}
+	}
+
+	for name, template := range b.Templates {
+		a.Templates[name] = template
+	}
 }
 
 // DefaultConfig returns a pointer to a populated Config object with sensible
@@ -54,9 +247,11 @@ func DefaultConfig() *Config {
 	hostname, _ := os.Hostname()
 
 	config := Config{
-		Config:      common.DefaultConfig(),
-		Name:        hostname,
-		Deployments: []DeploymentConfig{},
+		Config:         common.DefaultConfig(),
+		Name:           hostname,
+		Deployments:    []DeploymentConfig{},
+		GracePeriod:    30 * time.Second,
+		GracePeriodRaw: "30s",
 	}
 
 	LoadEnvironment(&config)
@@ -68,31 +263,39 @@ func LoadEnvironment(config *Config) {
 	name := os.Getenv("DEPRO_NAME")
 	if name != "" {
 		config.Name = name
+		config.SetSource("name", common.SourceEnvironment)
 	}
 }
 
-// ReadConfig reads a configuration file from the given path and returns it.
+// ReadConfig reads the configuration files, and directories of configuration
+// files, at the given paths and merges them in order. Problems with any of the
+// files are reported together once all of them have been read, along with
+// the configuration merged from the files which could be read.
 func ReadConfig(paths []string) (*Config, error) {
 	result := new(Config)
+	problems := common.Problems{}
 
 	for _, path := range paths {
 		f, err := os.Open(path)
 		if err != nil {
-			return nil, fmt.Errorf("Error reading '%s': %s", path, err)
+			problems = append(problems, common.Problem{File: path, Message: err.Error()})
+			continue
 		}
 
 		fi, err := f.Stat()
 		if err != nil {
 			f.Close()
-			return nil, fmt.Errorf("Error reading '%s': %s", path, err)
+			problems = append(problems, common.Problem{File: path, Message: err.Error()})
+			continue
 		}
 
 		if !fi.IsDir() {
-			config, err := DecodeConfig(f)
 			f.Close()
 
+			config, err := readConfigFile(path)
 			if err != nil {
-				return nil, fmt.Errorf("Error decoding '%s': %s", path, err)
+				problems = append(problems, common.AsProblems(err).InFile(path)...)
+				continue
 			}
 
 			Merge(result, config)
@@ -102,7 +305,8 @@ func ReadConfig(paths []string) (*Config, error) {
 		contents, err := f.Readdir(-1)
 		f.Close()
 		if err != nil {
-			return nil, fmt.Errorf("Error reading '%s': %s", path, err)
+			problems = append(problems, common.Problem{File: path, Message: err.Error()})
+			continue
 		}
 
 		sort.Sort(dirEnts(contents))
@@ -113,65 +317,143 @@ func ReadConfig(paths []string) (*Config, error) {
 				continue
 			}
 
-			// If it isn't a JSON file, ignore it
-			if !strings.HasSuffix(fi.Name(), ".json") {
+			// If it isn't a JSON, HCL or YAML file, ignore it
+			if common.FormatOf(fi.Name()) == "" {
 				continue
 			}
 
 			subpath := filepath.Join(path, fi.Name())
-			f, err := os.Open(subpath)
-			if err != nil {
-				return nil, fmt.Errorf("Error reading '%s': %s", subpath, err)
-			}
-
-			config, err := DecodeConfig(f)
-			f.Close()
-
+			config, err := readConfigFile(subpath)
 			if err != nil {
-				return nil, fmt.Errorf("Error decoding '%s': %s", subpath, err)
+				problems = append(problems, common.AsProblems(err).InFile(subpath)...)
+				continue
 			}
 
 			Merge(result, config)
 		}
 	}
 
-	return result, nil
+	problems = append(problems, result.resolveTemplates(result.Deployments)...)
+
+	return result, problems.Err()
+}
+
+// readConfigFile decodes a single configuration file, recording the file
+// as the source of each of its values.
+func readConfigFile(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	config, err := DecodeConfigFormat(f, common.FileFormat(path))
+	if err != nil {
+		return nil, err
+	}
+
+	config.SetFileSource(path)
+	for i := range config.Deployments {
+		config.Deployments[i].source = path
+		config.Deployments[i].index = i
+	}
+
+	for name, template := range config.Templates {
+		template.source = path
+		config.Templates[name] = template
+	}
+
+	return config, nil
+}
+
+// agentFlags maps the names of the flags registered by ParseFlags to the
+// values they set.
+var agentFlags = map[string][]string{
+	"name":         {"name"},
+	"grace-period": {"gracePeriod"},
+	"control-addr": {"controlAddr"},
+	"config-kv":    {"configKV"},
+	"tag":          {"tags"},
 }
 
 func ParseFlags(config *Config, args []string, flags *flag.FlagSet) error {
-	flags.StringVar(&config.Name, "name", "", "name of agent when identifying in key store")
+	flags.StringVar(&config.Name, "name", config.Name, "name of agent when identifying in key store")
+	flags.DurationVar(&config.GracePeriod, "grace-period", config.GracePeriod, "time to wait for running tasks during shutdown")
+	flags.StringVar(&config.ControlAddr, "control-addr", config.ControlAddr, "address of the agent's control endpoint")
+	flags.StringVar(&config.ConfigKV, "config-kv", config.ConfigKV, "key prefix in Consul to read deployments from")
+
+	var tagPairs []string
+	flags.Var((*util.AppendSliceValue)(&tagPairs), "tag", "key=value tag describing the agent, may be repeated")
 
 	var configFiles []string
-	flags.Var((*util.AppendSliceValue)(&configFiles), "config-dir", "directory of json files to read")
-	flags.Var((*util.AppendSliceValue)(&configFiles), "config-file", "json file to read config from")
+	flags.Var((*util.AppendSliceValue)(&configFiles), "config-dir", "directory of json, hcl or yaml files to read")
+	flags.Var((*util.AppendSliceValue)(&configFiles), "config-file", "json, hcl or yaml file to read config from")
 
 	err := common.ParseFlags(&config.Config, args, flags)
 	if err != nil {
 		return err
 	}
 
+	for _, pair := range tagPairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Error parsing tag '%s': expected key=value", pair)
+		}
+
+		if config.Tags == nil {
+			config.Tags = map[string]string{}
+		}
+
+		config.Tags[parts[0]] = parts[1]
+	}
+
+	common.MarkFlags(&config.Config, flags, agentFlags)
+	if config.Source("gracePeriod") == common.SourceFlag {
+		config.GracePeriodRaw = config.GracePeriod.String()
+	}
+
 	if len(configFiles) > 0 {
 		cFile, err := ReadConfig(configFiles)
+		Merge(config, cFile)
+
 		if err != nil {
 			return err
 		}
-
-		Merge(config, cFile)
 	}
 
 	return nil
 }
 
-// DecodeConfig decodes a configuration file from an io.Reader stream and returns it.
+// DecodeConfig decodes a JSON configuration file from an io.Reader stream and returns it.
 func DecodeConfig(r io.Reader) (*Config, error) {
+	return DecodeConfigFormat(r, common.FormatJSON)
+}
+
+// DecodeConfigFormat decodes a configuration file in the given format from an
+// io.Reader stream and returns it.
+func DecodeConfigFormat(r io.Reader, format string) (*Config, error) {
 	var result Config
-	dec := json.NewDecoder(r)
 
-	if err := dec.Decode(&result); err != nil {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := common.Decode(bytes.NewReader(data), format, &result)
+	if err != nil {
 		return nil, err
 	}
 
-	err := result.Finalize()
+	for _, field := range fields {
+		result.SetSource(field, common.SourceFile)
+	}
+
+	if doc, err := common.ToJSON(data, format, &result); err == nil {
+		result.recordSetFields(doc)
+	}
+
+	err = result.Finalize()
 	if err != nil {
 		return nil, err
 	}
@@ -179,6 +461,151 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 	return &result, nil
 }
 
+// Finalize is responsible for performing any final conversions, such as
+// timeouts.
+func (c *Config) Finalize() error {
+	err := c.Config.Finalize()
+	if err != nil {
+		return err
+	}
+
+	if c.GracePeriodRaw != "" {
+		gracePeriod, err := time.ParseDuration(c.GracePeriodRaw)
+		if err != nil {
+			return common.Problems{{Field: "gracePeriod", Message: err.Error()}}
+		}
+
+		c.GracePeriod = gracePeriod
+	}
+
+	return nil
+}
+
+// Validate checks that the configuration describes a set of deployments
+// which can be run by the agent, reporting all of the problems found.
+func (c *Config) Validate() error {
+	problems := c.Config.Validate()
+	ids := map[string]*DeploymentConfig{}
+	paths := map[string]*DeploymentConfig{}
+
+	tags := make([]string, 0, len(c.Tags))
+	for key := range c.Tags {
+		tags = append(tags, key)
+	}
+	sort.Strings(tags)
+
+	for _, key := range tags {
+		if value := c.Tags[key]; key == "" || strings.ContainsAny(key, "=!,") || strings.Contains(value, ",") {
+			problems = append(problems, common.Problem{
+				File:    c.FileOf("tags"),
+				Field:   "tags",
+				Message: fmt.Sprintf("invalid tag '%s=%s', keys must not be empty or contain '=', '!' or ',' and values must not contain ','", key, value),
+			})
+		}
+	}
+
+	for i := range c.Deployments {
+		deployment := &c.Deployments[i]
+
+		problem := func(field, message string) {
+			problems = append(problems, common.Problem{
+				File:    deployment.source,
+				Field:   deployment.field(i, field),
+				Message: message,
+			})
+		}
+
+		if deployment.ID == "" {
+			problem("id", "is required")
+		} else if existing, exists := ids[deployment.ID]; exists {
+			if existing.source != "" {
+				problem("id", fmt.Sprintf("deployment '%s' is already defined in %s", deployment.ID, existing.source))
+			} else {
+				problem("id", fmt.Sprintf("deployment '%s' is defined more than once", deployment.ID))
+			}
+		} else {
+			ids[deployment.ID] = deployment
+		}
+
+		if deployment.Path == "" {
+			problem("path", "is required")
+		} else if existing, exists := paths[filepath.Clean(deployment.Path)]; exists {
+			// Deployments keep their local state and versions in their path,
+			// so they would overwrite each other's.
+			problem("path", fmt.Sprintf("path '%s' is already used by deployment '%s'", deployment.Path, existing.ID))
+		} else {
+			paths[filepath.Clean(deployment.Path)] = deployment
+		}
+
+		if deployment.Prefix == "" {
+			problem("prefix", "is required")
+		}
+
+		if !isKnownShell(deployment.Shell) {
+			problem("shell", fmt.Sprintf("unknown shell '%s', expected one of %s", deployment.Shell, strings.Join(knownShells[1:], ", ")))
+		}
+
+		if _, err := parseMode(deployment.DirMode, defaultDirMode); err != nil {
+			problem("dirMode", err.Error())
+		}
+
+		if _, err := parseMode(deployment.FileMode, defaultFileMode); err != nil {
+			problem("fileMode", err.Error())
+		}
+
+		if deployment.User != "" {
+			switch strings.ToLower(deployment.Shell) {
+			case "", "sh", "bash":
+			default:
+				problem("user", fmt.Sprintf("scripts can only be run as another user with the sh or bash shells, not '%s'", deployment.Shell))
+			}
+		}
+
+		if _, err := ordering.Parse(deployment.Ordering); err != nil {
+			problem("ordering", err.Error())
+		}
+
+		if _, err := states.CompileVersionPattern(deployment.VersionPattern); err != nil {
+			problem("versionPattern", err.Error())
+		}
+
+		hooks := deployment.hooks()
+		for _, name := range hookNames {
+			if hook := hooks[name]; hook != nil && !isHookPolicy(hook.Policy) {
+				problem(name+".policy", fmt.Sprintf("unknown policy '%s', expected one of %s", hook.Policy, strings.Join(hookPolicies[1:], ", ")))
+			}
+		}
+
+		if deployment.Consul != nil {
+			if _, err := deployment.ClientConfig(&c.Config).GetAPIClient(); err != nil {
+				problem("consul", err.Error())
+			}
+		}
+	}
+
+	return problems.Err()
+}
+
+func isKnownShell(shell string) bool {
+	for _, known := range knownShells {
+		if strings.ToLower(shell) == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isHookPolicy(policy string) bool {
+	for _, known := range hookPolicies {
+		if strings.ToLower(policy) == known {
+			return true
+		}
+	}
+
+	return false
+}
+
 type dirEnts []os.FileInfo
 
 func (d dirEnts) Len() int {
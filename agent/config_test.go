@@ -2,9 +2,16 @@ package agent
 
 import (
 	"bytes"
-	"github.com/EMSSConsulting/Depro/common"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/EMSSConsulting/Depro/common"
 )
 
 func TestDecodeConfig_Server(t *testing.T) {
@@ -88,3 +95,492 @@ func TestMerge(t *testing.T) {
 		t.Fatal("bad waitTime field")
 	}
 }
+
+func TestParseFlags_Tags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depro-agent")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "agent.json")
+	err = ioutil.WriteFile(configFile, []byte(`{"tags": {"region": "eu", "tier": "main"}}`), 0644)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config := DefaultConfig()
+	flags := flag.NewFlagSet("agent", flag.ContinueOnError)
+	err = ParseFlags(config, []string{"-tag", "tier=canary", "-tag", "rack=a1", "-config-file", configFile}, flags)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := map[string]string{"region": "eu", "tier": "main", "rack": "a1"}
+	if !reflect.DeepEqual(config.Tags, expected) {
+		t.Fatalf("bad tags, got %v, expected %v", config.Tags, expected)
+	}
+
+	config.Tags["bad,key"] = "value"
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected an invalid tag to be rejected")
+	}
+
+	config = DefaultConfig()
+	flags = flag.NewFlagSet("agent", flag.ContinueOnError)
+	if err := ParseFlags(config, []string{"-tag", "region"}, flags); err == nil {
+		t.Fatal("expected a tag without a value to be rejected")
+	}
+}
+
+func TestDecodeConfig_GracePeriod(t *testing.T) {
+	input := `{"gracePeriod": "45s"}`
+	config, err := DecodeConfig(bytes.NewReader([]byte(input)))
+
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.GracePeriod != 45*time.Second {
+		t.Fatalf("bad grace period, got '%v', expected '%v'", config.GracePeriod, 45*time.Second)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	config := Config{
+		Deployments: []DeploymentConfig{
+			{ID: "api", Path: "/data/deploy/api", Prefix: "api/version", Shell: "bash"},
+			{ID: "website", Path: "/data/deploy/website", Prefix: "website/version"},
+		},
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config.Deployments = append(config.Deployments, DeploymentConfig{ID: "api", Path: "/data/deploy/api", Prefix: "api/version"})
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected duplicate deployment IDs to be rejected")
+	}
+
+	config.Deployments = []DeploymentConfig{
+		{ID: "api", Path: "/data/deploy/api", Prefix: "api/version"},
+		{ID: "worker", Path: "/data/deploy/api/", Prefix: "worker/version"},
+	}
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("expected duplicate deployment paths to be rejected")
+	}
+
+	if problems := err.(common.Problems); len(problems) != 1 || problems[0].Field != "deployments[1].path" {
+		t.Fatalf("bad problems, got:\n%s", problems)
+	}
+
+	config.Deployments = []DeploymentConfig{{Shell: "fish"}}
+	err = config.Validate()
+	if err == nil {
+		t.Fatal("expected incomplete deployment to be rejected")
+	}
+
+	problems := err.(common.Problems)
+	if len(problems) != 4 {
+		t.Fatalf("bad problems, got %d, expected %d:\n%s", len(problems), 4, problems)
+	}
+
+	if problems[0].Field != "deployments[0].id" {
+		t.Fatalf("bad problem field, got '%s', expected '%s'", problems[0].Field, "deployments[0].id")
+	}
+
+	config.Deployments = []DeploymentConfig{
+		{ID: "api", Path: "/data/deploy/api", Prefix: "api/version", Shell: "powershell", User: "deploy", DirMode: "0750", FileMode: "rw-r--r--"},
+	}
+	err = config.Validate()
+	if err == nil {
+		t.Fatal("expected invalid permissions to be rejected")
+	}
+
+	problems = err.(common.Problems)
+	if len(problems) != 2 || problems[0].Field != "deployments[0].fileMode" || problems[1].Field != "deployments[0].user" {
+		t.Fatalf("bad problems, got:\n%s", problems)
+	}
+}
+
+func TestDecodeConfig_UnknownFields(t *testing.T) {
+	input := `{"nmae": "test", "deployments": [{"id": "api", "scripts": []}]}`
+	_, err := DecodeConfig(bytes.NewReader([]byte(input)))
+
+	if err == nil {
+		t.Fatal("expected unknown fields to be rejected")
+	}
+
+	problems := err.(common.Problems)
+	if len(problems) != 2 {
+		t.Fatalf("bad problems, got %d, expected %d:\n%s", len(problems), 2, problems)
+	}
+
+	if problems[0].Field != "deployments[0].scripts" || problems[1].Field != "nmae" {
+		t.Fatalf("bad problem fields, got '%s' and '%s'", problems[0].Field, problems[1].Field)
+	}
+}
+
+func TestMerge_AllowStale(t *testing.T) {
+	c1 := DefaultConfig()
+
+	c2, err := DecodeConfig(bytes.NewReader([]byte(`{"allowStale": false}`)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	Merge(c1, c2)
+
+	if c1.AllowStale {
+		t.Fatal("expected allowStale to be disabled")
+	}
+
+	if c1.Source("allowStale") != common.SourceFile {
+		t.Fatalf("bad allowStale source, got '%s', expected '%s'", c1.Source("allowStale"), common.SourceFile)
+	}
+}
+
+func TestDecodeConfigFormat_HCL(t *testing.T) {
+	input := `
+# Comments are allowed in HCL
+server = "127.0.0.1:8500"
+wait = "10s"
+
+deployments = [
+	{
+		id = "api"
+		prefix = "myapp/production/versions"
+		deploy = ["echo one", "echo two"]
+	}
+]
+`
+	config, err := DecodeConfigFormat(bytes.NewReader([]byte(input)), common.FormatHCL)
+
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.Server != "127.0.0.1:8500" {
+		t.Fatalf("bad server, got '%s', expected '%s'", config.Server, "127.0.0.1:8500")
+	}
+
+	if config.WaitTime != 10*time.Second {
+		t.Fatalf("bad wait time, got '%v', expected '%v'", config.WaitTime, 10*time.Second)
+	}
+
+	if len(config.Deployments) != 1 || len(config.Deployments[0].Deploy) != 2 {
+		t.Fatalf("bad deployments, got %#v", config.Deployments)
+	}
+}
+
+func TestDecodeConfigFormat_YAML(t *testing.T) {
+	input := `
+# Comments are allowed in YAML
+allowStale: false
+deployments:
+  - id: api
+    prefix: myapp/production/versions
+    rollout:
+      - echo one
+`
+	config, err := DecodeConfigFormat(bytes.NewReader([]byte(input)), common.FormatYAML)
+
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.IsSet("allowStale") || config.AllowStale {
+		t.Fatalf("bad allowStale, got '%v', expected '%v'", config.AllowStale, false)
+	}
+
+	if len(config.Deployments) != 1 || config.Deployments[0].Prefix != "myapp/production/versions" {
+		t.Fatalf("bad deployments, got %#v", config.Deployments)
+	}
+}
+
+func TestDecodeConfigFormat_Errors(t *testing.T) {
+	cases := []struct {
+		format string
+		input  string
+		line   string
+	}{
+		{common.FormatJSON, "{\n\"server\": \"127.0.0.1:8500\",\n\"wait\": }", "line 3"},
+		{common.FormatHCL, "server = \"127.0.0.1:8500\"\nwait = \"10s\n", "2:"},
+		{common.FormatYAML, "server: 127.0.0.1:8500\n  wait: : 10s\n", "line 2"},
+		{common.FormatHCL, "deployments = [{ id = \"api\" }, { id = \"web\", shell = [\"bash\"] }]\n", "deployments[1].shell"},
+		{common.FormatYAML, "deployments:\n  - id: api\n    consul:\n      insecureSkipVerify: maybe\n", "deployments[0].consul.insecureSkipVerify: cannot use string as bool"},
+	}
+
+	for _, c := range cases {
+		_, err := DecodeConfigFormat(bytes.NewReader([]byte(c.input)), c.format)
+		if err == nil {
+			t.Fatalf("%s: expected an error", c.format)
+		}
+
+		if !strings.Contains(err.Error(), c.line) {
+			t.Fatalf("%s: expected the error to include '%s', got '%s'", c.format, c.line, err)
+		}
+	}
+}
+
+func TestReadConfig_MixedFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depro-agent")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.json":    `{"name": "json", "deployments": [{"id": "api"}]}`,
+		"b.hcl":     "name = \"hcl\"\ndeployments = [{ id = \"website\" }]\n",
+		"c.yml":     "deployments:\n  - id: worker\n",
+		"d.txt":     "ignored",
+		"e.yaml":    "name: yaml\n",
+		"readme.md": "ignored",
+	}
+
+	for name, contents := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	config, err := ReadConfig([]string{dir})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.Name != "yaml" {
+		t.Fatalf("bad name, got '%s', expected '%s'", config.Name, "yaml")
+	}
+
+	ids := []string{}
+	for _, deployment := range config.Deployments {
+		ids = append(ids, deployment.ID)
+	}
+
+	if strings.Join(ids, ",") != "api,website,worker" {
+		t.Fatalf("bad deployment order, got '%s', expected '%s'", strings.Join(ids, ","), "api,website,worker")
+	}
+
+	if config.Source("name") != filepath.Join(dir, "e.yaml") {
+		t.Fatalf("bad name source, got '%s'", config.Source("name"))
+	}
+}
+
+func TestReadConfig_Templates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depro-agent")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.json": `{
+			"deployments": [
+				{"id": "api", "extends": "service"},
+				{"id": "website", "extends": "service", "path": "/var/www", "clean": [], "user": ""}
+			]
+		}`,
+		"b.json": `{
+			"templates": {
+				"base": {"prefix": "deploy/${id}", "clean": ["rm -rf ${path}/$VERSION"], "user": "deploy"},
+				"service": {"extends": "base", "path": "/data/${id}", "deploy": ["git clone ${prefix} ${path}"]}
+			}
+		}`,
+	}
+
+	for name, contents := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	config, err := ReadConfig([]string{dir})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	api := config.Deployments[0]
+	if api.Path != "/data/api" {
+		t.Fatalf("bad path, got '%s', expected '%s'", api.Path, "/data/api")
+	}
+
+	if api.Prefix != "deploy/api" {
+		t.Fatalf("bad prefix, got '%s', expected '%s'", api.Prefix, "deploy/api")
+	}
+
+	if len(api.Deploy) != 1 || api.Deploy[0] != "git clone deploy/api /data/api" {
+		t.Fatalf("bad deploy script, got %v", api.Deploy)
+	}
+
+	if len(api.Clean) != 1 || api.Clean[0] != "rm -rf /data/api/$VERSION" {
+		t.Fatalf("bad clean script, got %v", api.Clean)
+	}
+
+	website := config.Deployments[1]
+	if website.Path != "/var/www" {
+		t.Fatalf("bad path, got '%s', expected '%s'", website.Path, "/var/www")
+	}
+
+	if len(website.Deploy) != 1 || website.Deploy[0] != "git clone deploy/website /var/www" {
+		t.Fatalf("bad deploy script, got %v", website.Deploy)
+	}
+
+	if len(website.Clean) != 0 {
+		t.Fatalf("bad clean script, got %v", website.Clean)
+	}
+
+	// Values set to be empty are not inherited
+	if api.User != "deploy" || website.User != "" {
+		t.Fatalf("bad users, got '%s' and '%s', expected '%s' and '%s'", api.User, website.User, "deploy", "")
+	}
+
+	if config.Templates["service"].Path != "/data/${id}" {
+		t.Fatalf("bad template path, got '%s'", config.Templates["service"].Path)
+	}
+
+	if website.File() != filepath.Join(dir, "a.json") {
+		t.Fatalf("bad deployment source, got '%s'", website.File())
+	}
+}
+
+func TestReadConfig_TemplateErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depro-agent")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "agent.json")
+	err = ioutil.WriteFile(path, []byte(`{
+		"templates": {
+			"a": {"extends": "b"},
+			"b": {"extends": "a"}
+		},
+		"deployments": [
+			{"id": "api", "extends": "missing"},
+			{"id": "website", "extends": "a"}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	_, err = ReadConfig([]string{path})
+	problems := common.AsProblems(err)
+	if len(problems) != 2 {
+		t.Fatalf("bad problems, got %d, expected %d: %s", len(problems), 2, err)
+	}
+
+	expected := []string{
+		path + ": deployments[0].extends: unknown template 'missing', expected one of a, b",
+		path + ": deployments[1].extends: template 'a' extends itself through a -> b -> a",
+	}
+
+	for i, problem := range problems {
+		if problem.String() != expected[i] {
+			t.Fatalf("bad problem, got '%s', expected '%s'", problem.String(), expected[i])
+		}
+	}
+}
+
+func TestDecodeConfig_TLS(t *testing.T) {
+	input := `{
+		"scheme": "https",
+		"caFile": "/etc/depro/ca.pem",
+		"certFile": "/etc/depro/client.pem",
+		"keyFile": "/etc/depro/client-key.pem",
+		"tlsServerName": "consul.service.consul",
+		"insecureSkipVerify": true
+	}`
+
+	config, err := DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.Scheme != "https" {
+		t.Fatalf("bad scheme, got '%s', expected '%s'", config.Scheme, "https")
+	}
+
+	if config.CAFile != "/etc/depro/ca.pem" || config.CertFile != "/etc/depro/client.pem" || config.KeyFile != "/etc/depro/client-key.pem" {
+		t.Fatalf("bad certificate files, got '%s', '%s' and '%s'", config.CAFile, config.CertFile, config.KeyFile)
+	}
+
+	if config.TLSServerName != "consul.service.consul" {
+		t.Fatalf("bad TLS server name, got '%s', expected '%s'", config.TLSServerName, "consul.service.consul")
+	}
+
+	if !config.InsecureSkipVerify {
+		t.Fatalf("bad insecureSkipVerify, got %v, expected %v", config.InsecureSkipVerify, true)
+	}
+
+	merged := DefaultConfig()
+	Merge(merged, config)
+
+	if merged.Scheme != "https" || !merged.InsecureSkipVerify {
+		t.Fatalf("bad merged TLS configuration, got scheme '%s' and insecureSkipVerify %v", merged.Scheme, merged.InsecureSkipVerify)
+	}
+}
+
+func TestConfig_GetAPIClient(t *testing.T) {
+	config := DefaultConfig()
+	if _, err := config.GetAPIClient(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config.Scheme = "ftp"
+	if _, err := config.GetAPIClient(); err == nil {
+		t.Fatalf("expected an error for an unsupported scheme")
+	}
+
+	config.Scheme = "https"
+	config.CAFile = filepath.Join(os.TempDir(), "depro-missing-ca.pem")
+	if _, err := config.GetAPIClient(); err == nil {
+		t.Fatalf("expected an error for a missing CA file")
+	}
+}
+
+func TestDeploymentConfig_ClientConfig(t *testing.T) {
+	input := `{
+		"server": "consul.local:8500",
+		"token": "agent-token",
+		"deployments": [
+			{"id": "local"},
+			{"id": "remote", "consul": {"datacenter": "dc2", "token": "remote-token", "insecureSkipVerify": true}}
+		]
+	}`
+
+	config, err := DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	local := config.Deployments[0].ClientConfig(&config.Config)
+	if local.Token != "agent-token" || local.Datacenter != "" {
+		t.Fatalf("bad local client config, got token '%s' and datacenter '%s'", local.Token, local.Datacenter)
+	}
+
+	remote := config.Deployments[1].ClientConfig(&config.Config)
+	if remote.Server != "consul.local:8500" {
+		t.Fatalf("bad server, got '%s', expected '%s'", remote.Server, "consul.local:8500")
+	}
+
+	if remote.Token != "remote-token" || remote.Datacenter != "dc2" || !remote.InsecureSkipVerify {
+		t.Fatalf("bad remote client config, got token '%s', datacenter '%s' and insecureSkipVerify %v", remote.Token, remote.Datacenter, remote.InsecureSkipVerify)
+	}
+
+	if config.Token != "agent-token" || config.InsecureSkipVerify {
+		t.Fatalf("agent configuration was modified")
+	}
+
+	config.TokenFile = "/etc/depro/token"
+	if remote := config.Deployments[1].ClientConfig(&config.Config); remote.TokenFile != "" {
+		t.Fatalf("bad token file, got '%s', expected the deployment's token to replace it", remote.TokenFile)
+	}
+}
@@ -0,0 +1,419 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/EMSSConsulting/Depro/common"
+	"github.com/EMSSConsulting/Depro/ordering"
+	"github.com/EMSSConsulting/Depro/selector"
+	"github.com/EMSSConsulting/Depro/util"
+	"github.com/EMSSConsulting/waiter"
+	"github.com/hashicorp/consul/api"
+)
+
+// connections shares Consul clients, sessions and watches between the
+// deployments of an agent which connect to the same Consul servers, so that
+// the load the agent places on Consul does not grow with its deployments.
+// Connections are removed once no deployment uses them, as happens when a
+// reload changes the settings of every deployment using one.
+type connections struct {
+	lock   sync.Mutex
+	shared map[string]*connection
+}
+
+func newConnections() *connections {
+	return &connections{
+		shared: map[string]*connection{},
+	}
+}
+
+// get returns the connection shared by the deployments of the named agent
+// which connect to Consul with the given configuration. Every connection
+// which is returned must be released with release.
+func (c *connections) get(name string, config *common.Config) (*connection, error) {
+	settings, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("%s\n%s", name, settings)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if conn, exists := c.shared[key]; exists {
+		conn.users++
+		return conn, nil
+	}
+
+	client, err := config.GetAPIClient()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &connection{
+		key:     key,
+		name:    name,
+		config:  config,
+		client:  client,
+		users:   1,
+		watches: map[string]*prefixWatch{},
+	}
+
+	c.shared[key] = conn
+	return conn, nil
+}
+
+// release releases a connection returned by get, closing and removing it
+// once it has no more users.
+func (c *connections) release(conn *connection) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	conn.users--
+	if conn.users == 0 {
+		delete(c.shared, conn.key)
+		conn.close()
+	}
+}
+
+// connection is a client for a set of Consul servers along with the session
+// and watches shared by the deployments which use it.
+type connection struct {
+	key    string
+	name   string
+	config *common.Config
+	client *api.Client
+
+	// users is the number of deployments using the connection, guarded by
+	// the lock of the connections which holds it.
+	users int
+
+	// session is held while it has any users, and closed by the last.
+	sessionLock  sync.Mutex
+	session      *waiter.Session
+	sessionUsers int
+
+	watchLock sync.Mutex
+	watches   map[string]*prefixWatch
+
+	// datacenter is the datacenter of the Consul agent, once it is known.
+	datacenterLock sync.Mutex
+	datacenter     string
+}
+
+// getDatacenter returns the datacenter used by the connection, asking the
+// Consul agent for its own when none is configured. An empty string is
+// returned if the datacenter cannot be found.
+func (c *connection) getDatacenter() string {
+	if c.config.Datacenter != "" {
+		return c.config.Datacenter
+	}
+
+	c.datacenterLock.Lock()
+	defer c.datacenterLock.Unlock()
+
+	if c.datacenter != "" {
+		return c.datacenter
+	}
+
+	self, err := c.client.Agent().Self()
+	if err != nil {
+		return ""
+	}
+
+	if datacenter, ok := self["Config"]["Datacenter"].(string); ok {
+		c.datacenter = datacenter
+	}
+
+	return c.datacenter
+}
+
+// acquireSession returns the agent's session, creating it if no deployment
+// currently holds it. Failures are retried until the context is cancelled,
+// in which case nil is returned. The session's lock is not held between
+// retries, so other deployments may release their sessions meanwhile. Every
+// session which is acquired must be released with releaseSession.
+func (c *connection) acquireSession(ctx context.Context, d *Deployment) *waiter.Session {
+	backoff := util.Backoff{Min: retryMinDelay, Max: retryMaxDelay}
+
+	for {
+		c.sessionLock.Lock()
+
+		if c.session == nil {
+			session, err := waiter.NewSession(c.client, c.name)
+			if err != nil {
+				c.sessionLock.Unlock()
+
+				delay := backoff.Next()
+				d.markDegraded("session", fmt.Sprintf("unable to create session, retrying in %s: %s", delay, err))
+
+				if !util.Sleep(ctx, delay) {
+					return nil
+				}
+
+				continue
+			}
+
+			c.session = session
+		}
+
+		c.sessionUsers++
+		session := c.session
+		c.sessionLock.Unlock()
+
+		d.markHealthy("session")
+		return session
+	}
+}
+
+// releaseSession releases a session returned by acquireSession, closing it
+// once it has no more users.
+func (c *connection) releaseSession() {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+
+	c.sessionUsers--
+	if c.sessionUsers == 0 {
+		c.session.Close()
+		c.session = nil
+	}
+}
+
+// close stops any watches which remain once the connection has no users.
+func (c *connection) close() {
+	c.watchLock.Lock()
+	defer c.watchLock.Unlock()
+
+	for root, w := range c.watches {
+		w.stop()
+		delete(c.watches, root)
+	}
+}
+
+// subscribe delivers the versions and current version of the deployment to
+// its event loop until the context is cancelled, using a watch shared with
+// every deployment with the same prefix. The returned function must be
+// called once the deployment no longer needs the subscription.
+func (c *connection) subscribe(ctx context.Context, d *Deployment) func() {
+	root := strings.Trim(d.Config.Prefix, "/")
+	// The ordering has already been validated along with the rest of the
+	// deployment's configuration.
+	order, _ := ordering.Parse(d.Config.Ordering)
+
+	s := &subscription{
+		deployment: d,
+		prefix:     root,
+		order:      order,
+		tags:       d.agentConfig.Tags,
+		updated:    make(chan struct{}, 1),
+	}
+
+	c.watchLock.Lock()
+	w, exists := c.watches[root]
+	if !exists {
+		watchCtx, stop := context.WithCancel(context.Background())
+		w = &prefixWatch{
+			root:          root,
+			conn:          c,
+			subscriptions: map[*subscription]struct{}{},
+			stop:          stop,
+		}
+
+		c.watches[root] = w
+		go watch(watchCtx, "versions", w, w.query)
+	}
+
+	w.add(s)
+	c.watchLock.Unlock()
+
+	go s.run(ctx)
+
+	return func() {
+		c.watchLock.Lock()
+		defer c.watchLock.Unlock()
+
+		if w.remove(s) == 0 {
+			w.stop()
+			delete(c.watches, root)
+		}
+	}
+}
+
+// prefixWatch is a single recursive watch of a prefix which fans the keys
+// beneath it out to the subscribed deployments.
+type prefixWatch struct {
+	root string
+	conn *connection
+	stop context.CancelFunc
+
+	lock          sync.Mutex
+	subscriptions map[*subscription]struct{}
+	pairs         api.KVPairs
+	loaded        bool
+}
+
+func (w *prefixWatch) query(ctx context.Context, waitIndex uint64) (uint64, error) {
+	kv := w.conn.client.KV()
+
+	q := w.conn.config.QueryOptions()
+	q.WaitIndex = waitIndex
+
+	var pairs api.KVPairs
+	meta, err := w.conn.config.Read(q.WithContext(ctx), func(q *api.QueryOptions) (meta *api.QueryMeta, err error) {
+		pairs, meta, err = kv.List(fmt.Sprintf("%s/", w.root), q)
+		return meta, err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.pairs = pairs
+	w.loaded = true
+	for s := range w.subscriptions {
+		s.update(pairs)
+	}
+
+	return meta.LastIndex, nil
+}
+
+// add subscribes a deployment to the watch, delivering the keys already
+// read to it immediately.
+func (w *prefixWatch) add(s *subscription) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.subscriptions[s] = struct{}{}
+	if w.loaded {
+		s.update(w.pairs)
+	}
+}
+
+// remove unsubscribes a deployment from the watch, returning the number of
+// subscriptions which remain.
+func (w *prefixWatch) remove(s *subscription) int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	delete(w.subscriptions, s)
+	return len(w.subscriptions)
+}
+
+func (w *prefixWatch) markDegraded(name, message string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for s := range w.subscriptions {
+		s.deployment.markDegraded(name, message)
+	}
+}
+
+func (w *prefixWatch) markHealthy(name string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for s := range w.subscriptions {
+		s.deployment.markHealthy(name)
+	}
+}
+
+// subscription delivers changes to a deployment's versions from a shared
+// watch to the deployment's event loop. Only the latest keys are kept, so a
+// deployment which is slow to receive its events never holds up the watch.
+type subscription struct {
+	deployment *Deployment
+	prefix     string
+	order      ordering.Ordering
+	tags       map[string]string
+
+	lock    sync.Mutex
+	pairs   api.KVPairs
+	updated chan struct{}
+}
+
+func (s *subscription) update(pairs api.KVPairs) {
+	s.lock.Lock()
+	s.pairs = pairs
+	s.lock.Unlock()
+
+	select {
+	case s.updated <- struct{}{}:
+	default:
+	}
+}
+
+// run emits events for changes to the deployment's versions and current
+// version until the context is cancelled.
+func (s *subscription) run(ctx context.Context) {
+	var versions, skipped []string
+	var current string
+	first := true
+
+	for {
+		select {
+		case <-s.updated:
+		case <-ctx.Done():
+			return
+		}
+
+		s.lock.Lock()
+		pairs := s.pairs
+		s.lock.Unlock()
+
+		// Versions are listed newest first, so that the newest of several
+		// waiting versions is deployed first.
+		listed, nextCurrent := ordering.Collect(pairs, s.prefix)
+		s.order.Sort(listed)
+		nextVersions := ordering.IDs(listed)
+		nextSkipped := skippedVersions(listed, s.tags)
+
+		if first || !equalVersions(versions, nextVersions) || !equalVersions(skipped, nextSkipped) {
+			s.deployment.emit(ctx, versionsChanged{Versions: nextVersions, Skipped: nextSkipped})
+			versions = nextVersions
+			skipped = nextSkipped
+		}
+
+		if first || current != nextCurrent {
+			s.deployment.emit(ctx, currentVersionChanged{Version: nextCurrent})
+			current = nextCurrent
+		}
+
+		first = false
+	}
+}
+
+// skippedVersions returns the IDs of the versions whose selectors do not
+// match the agent's tags. Versions whose selectors cannot be read are
+// skipped, rather than being deployed to every node.
+func skippedVersions(versions []ordering.Version, tags map[string]string) []string {
+	skipped := []string{}
+	for _, version := range versions {
+		s, err := selector.Parse(version.Meta[selector.MetaKey])
+		if err != nil || !s.Matches(tags) {
+			skipped = append(skipped, version.ID)
+		}
+	}
+
+	return skipped
+}
+
+func equalVersions(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
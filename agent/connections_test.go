@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EMSSConsulting/Depro/common"
+	"github.com/EMSSConsulting/Depro/ordering"
+	"github.com/hashicorp/consul/api"
+)
+
+func TestConnections_Release(t *testing.T) {
+	config := common.DefaultConfig()
+	shared := newConnections()
+
+	conn, err := shared.get("agent", &config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if other, _ := shared.get("agent", &config); other != conn {
+		t.Fatal("expected the connection to be shared")
+	}
+
+	shared.release(conn)
+	if len(shared.shared) != 1 {
+		t.Fatalf("bad connections, got %d, expected %d", len(shared.shared), 1)
+	}
+
+	shared.release(conn)
+	if len(shared.shared) != 0 {
+		t.Fatalf("bad connections, got %d, expected %d", len(shared.shared), 0)
+	}
+
+	if other, _ := shared.get("agent", &config); other == conn {
+		t.Fatal("expected a released connection to be replaced")
+	}
+}
+
+func TestSubscription_Run(t *testing.T) {
+	pairs := api.KVPairs{
+		{Key: "apps/api/1.0/node1", Value: []byte("available"), CreateIndex: 5},
+		{Key: "apps/api/1.2/node1", Value: []byte("available"), CreateIndex: 7},
+		{Key: "apps/api/1.1/node1", Value: []byte("deploying"), CreateIndex: 9},
+		{Key: "apps/api/current", Value: []byte("1.0")},
+		{Key: "apps/api2/2.0/node1", Value: []byte("available"), CreateIndex: 11},
+	}
+
+	cases := map[string]string{
+		"":       "1.1,1.2,1.0",
+		"semver": "1.2,1.1,1.0",
+	}
+
+	for spec, expected := range cases {
+		order, _ := ordering.Parse(spec)
+		d := &Deployment{Config: &DeploymentConfig{ID: "api"}, events: make(chan event)}
+		s := &subscription{deployment: d, prefix: "apps/api", order: order, updated: make(chan struct{}, 1)}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s.update(pairs)
+		go s.run(ctx)
+
+		changed := (<-d.events).(versionsChanged)
+		if strings.Join(changed.Versions, ",") != expected {
+			t.Fatalf("bad versions for '%s', got '%s', expected '%s'", spec, strings.Join(changed.Versions, ","), expected)
+		}
+
+		if current := (<-d.events).(currentVersionChanged); current.Version != "1.0" {
+			t.Fatalf("bad current version, got '%s', expected '%s'", current.Version, "1.0")
+		}
+
+		cancel()
+	}
+}
+
+func TestConnection_Subscribe(t *testing.T) {
+	defer func(interval time.Duration) {
+		watchMinInterval = interval
+	}(watchMinInterval)
+	watchMinInterval = time.Millisecond
+
+	var lock sync.Mutex
+	paths := map[string]int{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		paths[r.URL.Path]++
+		lock.Unlock()
+
+		// Blocking queries wait for a change which never comes.
+		if r.URL.Query().Get("index") != "" {
+			<-r.Context().Done()
+			return
+		}
+
+		w.Header().Set("X-Consul-Index", "7")
+		json.NewEncoder(w).Encode(api.KVPairs{
+			{Key: "apps/api/1.0/node1", Value: []byte("available")},
+			{Key: "apps/api/current", Value: []byte("1.0")},
+			{Key: "apps/web/2.0/node1", Value: []byte("available")},
+		})
+	}))
+	defer server.Close()
+
+	config := common.DefaultConfig()
+	config.Server = server.Listener.Addr().String()
+
+	conn, err := newConnections().get("agent", &config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	deployments := []*Deployment{
+		{Config: &DeploymentConfig{ID: "api", Prefix: "apps/api"}, agentConfig: &Config{}, events: make(chan event)},
+		{Config: &DeploymentConfig{ID: "api-canary", Prefix: "/apps/api/"}, agentConfig: &Config{}, events: make(chan event)},
+		{Config: &DeploymentConfig{ID: "web", Prefix: "apps/web"}, agentConfig: &Config{}, events: make(chan event)},
+	}
+
+	expected := []string{"1.0", "1.0", "2.0"}
+	for i, d := range deployments {
+		unsubscribe := conn.subscribe(ctx, d)
+		defer unsubscribe()
+
+		select {
+		case e := <-d.events:
+			changed, ok := e.(versionsChanged)
+			if !ok || len(changed.Versions) != 1 || changed.Versions[0] != expected[i] {
+				t.Fatalf("bad event for '%s', got %#v", d.Config.ID, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the versions of '%s'", d.Config.ID)
+		}
+	}
+
+	if len(conn.watches) != 2 {
+		t.Fatalf("bad watches, got %d, expected %d", len(conn.watches), 2)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	for path := range paths {
+		if path != "/v1/kv/apps/api/" && path != "/v1/kv/apps/web/" {
+			t.Fatalf("bad request path, got '%s'", path)
+		}
+	}
+}
+
+func TestSkippedVersions(t *testing.T) {
+	versions := []ordering.Version{
+		{ID: "1.0"},
+		{ID: "1.1", Meta: map[string]string{"selector": "region=eu"}},
+		{ID: "1.2", Meta: map[string]string{"selector": "region=us"}},
+		{ID: "1.3", Meta: map[string]string{"selector": "region"}},
+	}
+
+	skipped := skippedVersions(versions, map[string]string{"region": "eu"})
+	if strings.Join(skipped, ",") != "1.2,1.3" {
+		t.Fatalf("bad skipped versions, got '%s', expected '%s'", strings.Join(skipped, ","), "1.2,1.3")
+	}
+}
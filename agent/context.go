@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/EMSSConsulting/Depro/version"
+)
+
+// scriptContext describes the situation in which one of a deployment's
+// scripts is run. It is exported to the script through its environment, and
+// written in full to the JSON file named by DEPRO_CONTEXT.
+type scriptContext struct {
+	Agent      agentContext      `json:"agent"`
+	Deployment deploymentContext `json:"deployment"`
+	Datacenter string            `json:"datacenter"`
+
+	Version string `json:"version"`
+	Path    string `json:"path"`
+
+	// Phase is the phase being run, one of deploy, rollout or clean, while
+	// Step is the script or hook within it.
+	Phase   string `json:"phase"`
+	Step    string `json:"step"`
+	Attempt int    `json:"attempt"`
+
+	// PreviousVersion is the version rolled out on the local node when the
+	// phase started, CurrentVersion is the current version set in Consul and
+	// Versions are all of the versions listed in Consul.
+	PreviousVersion string   `json:"previousVersion"`
+	CurrentVersion  string   `json:"currentVersion"`
+	Versions        []string `json:"versions"`
+
+	// Metadata is the metadata attached to the version when it was deployed.
+	Metadata map[string]string `json:"metadata"`
+
+	// Failure describes the step which failed, for the onFailure hook.
+	Failure *failureContext `json:"failure,omitempty"`
+}
+
+type agentContext struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type deploymentContext struct {
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+	Prefix string `json:"prefix"`
+}
+
+type failureContext struct {
+	Phase    string `json:"phase"`
+	Step     string `json:"step"`
+	ExitCode *int   `json:"exitCode"`
+	Error    string `json:"error"`
+}
+
+// newScriptContext describes the situation in which a task is starting. It
+// reads the deployment's state machine, so must be called by the event loop.
+func (d *Deployment) newScriptContext(v *Version, phase taskKind) *scriptContext {
+	return &scriptContext{
+		Agent: agentContext{
+			Name:    d.agentConfig.Name,
+			Version: version.Version,
+		},
+		Deployment: deploymentContext{
+			ID:     d.Config.ID,
+			Path:   d.Config.Path,
+			Prefix: d.Config.Prefix,
+		},
+		Version:         v.ID,
+		Path:            v.fullPath(),
+		Phase:           string(phase),
+		Attempt:         v.attempt(phase),
+		PreviousVersion: d.machine.active,
+		CurrentVersion:  d.machine.desired,
+		Versions:        append([]string{}, d.machine.versions...),
+	}
+}
+
+// environment returns the variables exported to a script run in the context,
+// in addition to those describing its deployment.
+func (c *scriptContext) environment() map[string]string {
+	env := map[string]string{
+		"VERSION_PATH":      c.Path,
+		"PREVIOUS_VERSION":  c.PreviousVersion,
+		"CURRENT_VERSION":   c.CurrentVersion,
+		"PHASE":             c.Phase,
+		"STEP":              c.Step,
+		"ATTEMPT":           strconv.Itoa(c.Attempt),
+		"CONSUL_DATACENTER": c.Datacenter,
+	}
+
+	for key, value := range c.Metadata {
+		env[metaVariable(key)] = value
+	}
+
+	if c.Failure != nil {
+		env["FAILED_PHASE"] = c.Failure.Phase
+		env["FAILED_STEP"] = c.Failure.Step
+		env["EXIT_CODE"] = ""
+		if c.Failure.ExitCode != nil {
+			env["EXIT_CODE"] = strconv.Itoa(*c.Failure.ExitCode)
+		}
+	}
+
+	return env
+}
+
+// metaVariable returns the name of the environment variable holding a
+// metadata value, made up of upper case letters, digits and underscores.
+func metaVariable(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+
+		return '_'
+	}, key)
+
+	return fmt.Sprintf("DEPRO_META_%s", name)
+}
+
+// writeFile writes the context to a temporary JSON file, returning its path.
+// The file must be removed once the script has finished with it.
+func (c *scriptContext) writeFile() (string, error) {
+	contents, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile("", "depro-context-")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.Write(contents)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
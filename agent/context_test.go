@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/EMSSConsulting/Depro/states"
+)
+
+func TestDeployment_NewScriptContext(t *testing.T) {
+	d := &Deployment{
+		Config:      &DeploymentConfig{ID: "api", Path: "/data/api", Prefix: "apps/api"},
+		agentConfig: &Config{Name: "node1"},
+		machine:     newMachine("v1", func(string) states.State { return states.Available }, func(string) bool { return true }),
+	}
+	d.machine.versions = []string{"v1", "v2"}
+	d.machine.desired = "v2"
+
+	v := &Version{ID: "v2", deployment: d, attempts: map[taskKind]int{}}
+	d.newScriptContext(v, rolloutTask)
+	run := d.newScriptContext(v, rolloutTask)
+
+	env := run.environment()
+	expected := map[string]string{
+		"VERSION_PATH":     "/data/api/v2",
+		"PREVIOUS_VERSION": "v1",
+		"CURRENT_VERSION":  "v2",
+		"PHASE":            "rollout",
+		"ATTEMPT":          "2",
+	}
+
+	for name, value := range expected {
+		if env[name] != value {
+			t.Fatalf("bad %s, got '%s', expected '%s'", name, env[name], value)
+		}
+	}
+
+	run.Metadata = map[string]string{"commit": "abc123", "build-url": "http://ci/1"}
+	env = run.environment()
+	if env["DEPRO_META_COMMIT"] != "abc123" || env["DEPRO_META_BUILD_URL"] != "http://ci/1" {
+		t.Fatalf("bad metadata environment, got '%s' and '%s'", env["DEPRO_META_COMMIT"], env["DEPRO_META_BUILD_URL"])
+	}
+
+	if _, exists := env["FAILED_PHASE"]; exists {
+		t.Fatalf("bad environment, expected no failure outside of onFailure")
+	}
+}
+
+func TestScriptContext_WriteFile(t *testing.T) {
+	code := 3
+	run := &scriptContext{
+		Version: "v2",
+		Phase:   "deploy",
+		Step:    "onFailure",
+		Failure: &failureContext{Phase: "deploy", Step: "postDeploy", ExitCode: &code},
+	}
+
+	path, err := run.writeFile()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(path)
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var decoded scriptContext
+	if err := json.Unmarshal(contents, &decoded); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if decoded.Version != "v2" || decoded.Failure == nil || decoded.Failure.Step != "postDeploy" {
+		t.Fatalf("bad context, got %#v", decoded)
+	}
+
+	if env := run.environment(); env["EXIT_CODE"] != "3" || env["FAILED_STEP"] != "postDeploy" {
+		t.Fatalf("bad failure environment, got exit code '%s' and step '%s'", env["EXIT_CODE"], env["FAILED_STEP"])
+	}
+}
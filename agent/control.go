@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// ControlServer exposes an HTTP endpoint which allows the agent to be managed
+// while it is running.
+//
+//	POST /v1/reload    Reloads the agent's configuration
+type ControlServer struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// NewControlServer starts listening on the given address, calling reload
+// whenever a reload is requested.
+func NewControlServer(addr string, reload func() error) (*ControlServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" && r.Method != "PUT" {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		err := reload()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fmt.Fprintln(w, "configuration reloaded")
+	})
+
+	return &ControlServer{
+		listener: listener,
+		server:   &http.Server{Handler: mux},
+	}, nil
+}
+
+// Addr returns the address the control endpoint is listening on.
+func (s *ControlServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Run serves requests until the context is cancelled.
+func (s *ControlServer) Run(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		s.server.Close()
+	}()
+
+	err := s.server.Serve(s.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestControlServer_Reload(t *testing.T) {
+	reloads := 0
+	var reloadErr error
+
+	server, err := NewControlServer("127.0.0.1:0", func() error {
+		reloads++
+		return reloadErr
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go server.Run(ctx)
+
+	url := fmt.Sprintf("http://%s/v1/reload", server.Addr())
+
+	resp, err := http.Post(url, "text/plain", nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || reloads != 1 {
+		t.Fatalf("bad reload, got status %d after %d reloads", resp.StatusCode, reloads)
+	}
+
+	reloadErr = errors.New("invalid configuration")
+	resp, err = http.Post(url, "text/plain", nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad status for failed reload, got %d, expected %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed || reloads != 2 {
+		t.Fatalf("bad status for GET, got %d after %d reloads", resp.StatusCode, reloads)
+	}
+}
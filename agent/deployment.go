@@ -1,14 +1,18 @@
 package agent
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"reflect"
+	"regexp"
 	"strings"
+	"sync"
 
-	"github.com/EMSSConsulting/Depro/util"
+	"github.com/EMSSConsulting/Depro/states"
 	"github.com/EMSSConsulting/waiter"
 	"github.com/hashicorp/consul/api"
 	"github.com/mitchellh/cli"
@@ -16,51 +20,130 @@ import (
 
 // Deployment describes the internal state of a deployment which consists
 // of multiple versions.
-// Deployments are each responsible for controlling the lifespan of their
-// session as they may be created and destroyed at any time.
+// Deployments share their Consul session and watches with the agent's other
+// deployments, holding them only while they are running.
 type Deployment struct {
+	// Config is the configuration the deployment was started with, its
+	// scripts may since have been replaced using Reconfigure.
 	Config *DeploymentConfig
 
-	agentConfig    *Config
-	client         *api.Client
-	ui             cli.Ui
-	session        *waiter.Session
-	versions       map[string]*Version
+	live     *DeploymentConfig
+	liveLock sync.RWMutex
+
+	agentConfig *Config
+	ui          cli.Ui
+
+	// shared holds the connections shared by the agent's deployments, while
+	// conn, client and session belong to the one used by this deployment.
+	shared  *connections
+	conn    *connection
+	client  *api.Client
+	session *waiter.Session
+
+	// versions and machine are owned by the event loop in Run and must
+	// not be accessed from any other goroutine, as is released, which holds
+	// the versions which have been released but may not yet have removed
+	// their entries.
+	versions map[string]*Version
+	released map[string]*Version
+	machine  *machine
+	events   chan event
+
+	// pattern is the compiled pattern which version IDs must match.
+	pattern *regexp.Regexp
+
+	// store keeps the state of the deployment's versions on the local node
+	// across restarts of the agent.
+	store *stateStore
+
+	// registrations tracks the running version registrations so that
+	// their node keys can be released before the session is closed.
+	registrations sync.WaitGroup
+
+	// degraded holds the parts of the deployment which are currently unable
+	// to reach Consul.
+	degraded     map[string]struct{}
+	degradedLock sync.Mutex
 
 	log *log.Logger
 	err *log.Logger
-
-	deployVersion   chan *Version
-	rolloutVersion  chan *Version
-	cleanVersion    chan *Version
-	registerVersion chan *Version
 }
 
 func NewDeployment(operation *Operation, config *DeploymentConfig) *Deployment {
 	d := &Deployment{
 		Config: config,
+		live:   config,
 
 		agentConfig: operation.Config,
-		client:      operation.Config.GetAPIClient(),
 		ui:          operation.UI,
+		shared:      operation.connections,
 		versions:    map[string]*Version{},
+		released:    map[string]*Version{},
+		degraded:    map[string]struct{}{},
 
 		log: log.New(os.Stdout, fmt.Sprintf("[%s]", config.ID), log.Ltime),
 		err: log.New(os.Stderr, fmt.Sprintf("ERROR: [%s]", config.ID), log.Ltime|log.Lshortfile),
 
-		deployVersion:   make(chan *Version),
-		rolloutVersion:  make(chan *Version),
-		cleanVersion:    make(chan *Version),
-		registerVersion: make(chan *Version),
+		events: make(chan event),
 	}
 
 	return d
 }
 
+// Reconfigure replaces the shell and scripts used by the deployment, taking
+// effect from the next task it runs. Changes to any other part of the
+// configuration require the deployment to be restarted.
+func (d *Deployment) Reconfigure(config *DeploymentConfig) error {
+	if requiresRestart(d.Config, config) {
+		return fmt.Errorf("deployment '%s' must be restarted to apply the new configuration", d.Config.ID)
+	}
+
+	d.liveLock.Lock()
+	defer d.liveLock.Unlock()
+
+	d.live = config
+	return nil
+}
+
+// settings returns the deployment's current configuration.
+func (d *Deployment) settings() *DeploymentConfig {
+	d.liveLock.RLock()
+	defer d.liveLock.RUnlock()
+
+	return d.live
+}
+
+// requiresRestart reports whether a deployment running with the old
+// configuration needs to be restarted to apply the new one.
+func requiresRestart(old, new *DeploymentConfig) bool {
+	if old.ID != new.ID || old.Path != new.Path || old.Prefix != new.Prefix || old.Ordering != new.Ordering ||
+		old.VersionPattern != new.VersionPattern {
+		return true
+	}
+
+	return !reflect.DeepEqual(old.Consul, new.Consul)
+}
+
+// nodePrefix returns the key prefix beneath which agents running the
+// deployment register themselves.
+func (d *Deployment) nodePrefix() string {
+	return fmt.Sprintf("%s/%s", strings.Trim(d.Config.Prefix, "/"), states.NodesKey)
+}
+
 func (d *Deployment) versionPrefix(version string) string {
 	return fmt.Sprintf("%s/%s", strings.Trim(d.Config.Prefix, "/"), strings.Trim(version, "/"))
 }
 
+// checkVersion reports why a version's ID may not be deployed, if it may not.
+func (d *Deployment) checkVersion(version string) error {
+	return states.ValidateVersion(version, d.pattern)
+}
+
+// validVersion reports whether a version's ID may be deployed.
+func (d *Deployment) validVersion(version string) bool {
+	return d.checkVersion(version) == nil
+}
+
 func (d *Deployment) fullPath(version string) string {
 	if version == "" {
 		return d.Config.Path
@@ -105,6 +188,11 @@ func (d *Deployment) directory(version string) (os.FileInfo, error) {
 }
 
 func (d *Deployment) currentVersion() string {
+	if current, recorded := d.store.current(); recorded {
+		return current
+	}
+
+	// Agents which did not keep their local state only wrote the current file
 	currentVersionFilePath := path.Join(d.Config.Path, "current")
 
 	fContents, err := ioutil.ReadFile(currentVersionFilePath)
@@ -116,10 +204,17 @@ func (d *Deployment) currentVersion() string {
 	return string(fContents)
 }
 
+// updateCurrentVersion records the version most recently rolled out, which
+// is also written to the current file for the benefit of scripts and tools
+// which read it.
 func (d *Deployment) updateCurrentVersion(version string) error {
+	if err := d.store.setCurrent(version); err != nil {
+		return err
+	}
+
 	currentVersionFilePath := path.Join(d.Config.Path, "current")
 
-	return ioutil.WriteFile(currentVersionFilePath, []byte(version), 0)
+	return d.settings().writeFile(currentVersionFilePath, []byte(version))
 }
 
 func (d *Deployment) availableVersions() ([]string, error) {
@@ -153,255 +248,293 @@ func (d *Deployment) availableVersions() ([]string, error) {
 	return versions, nil
 }
 
-func (d *Deployment) fetchVersions(waitIndex uint64) ([]string, uint64, error) {
-	kv := d.client.KV()
+// versionExists reports whether a version has been deployed on the local node.
+func (d *Deployment) versionExists(version string) bool {
+	f, err := os.Open(d.fullPath(version))
 
-	keys, meta, err := kv.Keys(fmt.Sprintf("%s/", d.Config.Prefix), "/", &api.QueryOptions{
-		WaitIndex: waitIndex,
-	})
+	if err != nil {
+		return false
+	}
 
+	defer f.Close()
+
+	fInfo, err := f.Stat()
 	if err != nil {
-		return nil, 0, err
+		return false
 	}
 
-	fixedKeys := keys[:0]
-	for _, key := range keys {
-		fixedKey := strings.Trim(key[len(d.Config.Prefix):], "/")
-		if fixedKey == "" {
-			continue
-		}
+	return fInfo.IsDir()
+}
 
-		if fixedKey == "current" {
-			continue
+// localState reports the state of a version on the local node as it was
+// last recorded. Versions which have been deployed are Available and those
+// which failed are Failed, while versions which have not been deployed, or
+// whose deployment was interrupted, are Unregistered.
+func (d *Deployment) localState(version string) states.State {
+	if !d.versionExists(version) {
+		return states.Unregistered
+	}
+
+	local, recorded := d.store.version(version)
+	if !recorded {
+		// Without any local state, as when upgrading from an agent which did
+		// not keep it, every version directory is assumed to be deployed.
+		if !d.store.restored {
+			return states.Available
 		}
 
-		fixedKeys = append(fixedKeys, fixedKey)
+		return states.Unregistered
+	}
+
+	switch local.Record.State {
+	case states.Failed:
+		return states.Failed
+	case states.Available, states.Starting, states.Active:
+		return states.Available
 	}
 
-	return fixedKeys, meta.LastIndex, nil
+	return states.Unregistered
 }
 
-func (d *Deployment) fetchCurrentVersion(waitIndex uint64) (string, uint64, error) {
-	kv := d.client.KV()
+// versionMeta reads the metadata attached to a version when it was deployed,
+// which is empty if it has none or cannot be read.
+func (d *Deployment) versionMeta(version string) map[string]string {
+	key := fmt.Sprintf("%s/%s", d.versionPrefix(version), states.MetaKey)
 
-	key, meta, err := kv.Get(fmt.Sprintf("%s/current", d.Config.Prefix), &api.QueryOptions{
-		WaitIndex: waitIndex,
+	config := d.conn.config
+	var pair *api.KVPair
+	_, err := config.Read(config.QueryOptions(), func(q *api.QueryOptions) (meta *api.QueryMeta, err error) {
+		pair, meta, err = d.client.KV().Get(key, q)
+		return meta, err
 	})
-
 	if err != nil {
-		return "", 0, err
+		d.err.Printf("could not read metadata for {%s}: %s\n", version, err)
+		return map[string]string{}
 	}
 
-	if key == nil {
-		return "", meta.LastIndex, nil
+	if pair == nil {
+		return map[string]string{}
 	}
 
-	return string(key.Value), meta.LastIndex, nil
+	meta, err := states.ParseMeta(pair.Value)
+	if err != nil {
+		d.err.Printf("could not parse metadata for {%s}: %s\n", version, err)
+		return map[string]string{}
+	}
+
+	return meta
 }
 
-func (d *Deployment) diffVersions(oldVersions, newVersions []string) {
-	oldVersionsSet := util.SliceToMap(oldVersions)
-	newVersionsSet := util.SliceToMap(newVersions)
+// emit delivers an event to the event loop, giving up if the context is
+// cancelled first.
+func (d *Deployment) emit(ctx context.Context, e event) {
+	select {
+	case d.events <- e:
+	case <-ctx.Done():
+	}
+}
 
-	for _, id := range oldVersions {
-		_, exists := newVersionsSet[id]
-		if !exists && d.cleanVersion != nil {
-			d.log.Printf("got remove {%s}\n", id)
+// apply performs the actions requested by the state machine.
+func (d *Deployment) apply(actions []action) {
+	for _, a := range actions {
+		switch a := a.(type) {
+		case registerVersion:
+			version := newVersion(d, a.Version)
+			d.versions[a.Version] = version
 
-			version, exists := d.versions[id]
-			if exists {
-				d.cleanVersion <- version
-			}
-		}
-	}
+			// A previous registration of the version must remove its entry
+			// before the new one writes it, or it would remove the new one.
+			previous := d.released[a.Version]
+			delete(d.released, a.Version)
 
-	for _, id := range newVersions {
-		_, exists := oldVersionsSet[id]
-		if !exists && d.deployVersion != nil {
-			d.log.Printf("got deploy {%s}\n", id)
-			version, exists := d.versions[id]
-			if !exists {
-				version = newVersion(d, id)
-				d.versions[id] = version
+			d.registrations.Add(1)
+			go func() {
+				defer d.registrations.Done()
 
-				d.registerVersion <- version
-			}
+				if previous != nil {
+					<-previous.released
+				}
 
-			if version.exists() {
-				if version.ID == d.currentVersion() {
-					d.rolloutVersion <- version
-				} else {
-					version.setState("available", false)
+				err := version.register()
+				if err != nil {
+					d.err.Printf("could not register {%s}: %s\n", version.ID, err)
+					d.ui.Error(fmt.Sprintf("[%s] version '%s' not registered: %s", d.Config.ID, version.ID, err))
 				}
-			} else {
-				d.deployVersion <- version
+			}()
+		case releaseVersion:
+			if version, exists := d.versions[a.Version]; exists {
+				version.shutdown()
+				delete(d.versions, a.Version)
+				d.released[a.Version] = version
 			}
-		}
-	}
-}
 
-func (d *Deployment) diffCurrentVersion(oldVer, newVer string) {
-	if oldVer != newVer {
-		if newVer != "" && d.rolloutVersion != nil {
-			d.log.Printf("got rollout {%s}\n", newVer)
+			d.pruneReleased()
+		case publishState:
+			switch a.State {
+			case states.Invalid:
+				err := d.checkVersion(a.Version)
+				d.err.Printf("rejected version {%s}: %s\n", a.Version, err)
+				d.ui.Warn(fmt.Sprintf("[%s] version '%s' rejected: %s", d.Config.ID, a.Version, err))
+			case states.Skipped:
+				d.log.Printf("skipping version {%s}, its selector does not match the agent's tags\n", a.Version)
+			}
 
-			version, exists := d.versions[newVer]
+			if version, exists := d.versions[a.Version]; exists {
+				version.setState(a.State)
+			}
+		case activateVersion:
+			err := d.updateCurrentVersion(a.Version)
+			if err != nil {
+				d.err.Printf("could not record current version {%s}: %s\n", a.Version, err)
+			}
+		case startTask:
+			version, exists := d.versions[a.Task.Version]
 			if !exists {
-				version = newVersion(d, newVer)
-				d.versions[newVer] = version
-
-				d.registerVersion <- version
+				// The machine must still be told that the task has finished
+				d.err.Printf("could not start %s of {%s}: the version is no longer registered\n", a.Task.Kind, a.Task.Version)
+				go func(t task) {
+					d.events <- taskCompleted{Task: t, Err: fmt.Errorf("version '%s' is no longer registered", t.Version)}
+				}(a.Task)
+				continue
 			}
 
-			if !version.exists() {
-				d.deployVersion <- version
-			} else {
-				d.rolloutVersion <- version
-			}
+			go d.runTask(version, a.Task, d.newScriptContext(version, a.Task.Kind))
 		}
 	}
 }
 
-func (d *Deployment) watchVersions() error {
-	versions := []string{}
-
-	lastWaitIndex := uint64(0)
-
-	for range util.NotShutdown() {
-		newVersions, nextWaitIndex, err := d.fetchVersions(lastWaitIndex)
-		if err != nil {
-			return err
+// pruneReleased forgets the released versions which have removed their
+// entries.
+func (d *Deployment) pruneReleased() {
+	for id, version := range d.released {
+		select {
+		case <-version.released:
+			delete(d.released, id)
+		default:
 		}
-
-		d.diffVersions(versions, newVersions)
-
-		versions = newVersions
-		lastWaitIndex = nextWaitIndex
 	}
-
-	return nil
 }
 
-func (d *Deployment) watchCurrentVersion() error {
-	currentVersion := d.currentVersion()
+// runTask runs a task's scripts and reports its completion to the event loop,
+// which is guaranteed to be waiting for it.
+func (d *Deployment) runTask(version *Version, t task, run *scriptContext) {
+	var outputs []scriptOutput
+	var err error
 
-	lastWaitIndex := uint64(0)
+	run.Datacenter = d.conn.getDatacenter()
+	run.Metadata = d.versionMeta(version.ID)
 
-	for range util.NotShutdown() {
-		newCurrentVersion, newWaitIndex, err := d.fetchCurrentVersion(lastWaitIndex)
+	switch t.Kind {
+	case deployTask:
+		outputs, err = version.deploy(run)
 		if err != nil {
-			return err
+			d.ui.Error(fmt.Sprintf("[%s] version '%s' deployment failed: %s", d.Config.ID, version.ID, err))
+		} else {
+			d.ui.Output(fmt.Sprintf("[%s] version '%s' deployed", d.Config.ID, version.ID))
 		}
+	case rolloutTask:
+		outputs, err = version.rollout(run)
+		if err != nil {
+			d.ui.Error(fmt.Sprintf("[%s] version '%s' rollout failed: %s", d.Config.ID, version.ID, err))
+		}
+	case cleanTask:
+		outputs, err = version.clean(run)
+		if err != nil {
+			d.ui.Error(fmt.Sprintf("[%s] version '%s' cleanup failed: %s", d.Config.ID, version.ID, err))
+		} else {
+			d.ui.Output(fmt.Sprintf("[%s] version '%s' removed", d.Config.ID, version.ID))
+		}
+	}
 
-		lastWaitIndex = newWaitIndex
-
-		d.diffCurrentVersion(currentVersion, newCurrentVersion)
-		currentVersion = newCurrentVersion
+	for _, output := range outputs {
+		if output.Output != "" {
+			d.ui.Info(fmt.Sprintf("[%s@%s] %s:\n%s", d.Config.ID, version.ID, output.Step, output.Output))
+		}
 	}
 
-	return nil
+	d.events <- taskCompleted{Task: t, Err: err}
 }
 
-func (d *Deployment) Run() error {
-	session, err := waiter.NewSession(d.client, d.Config.ID)
-
+// Run watches the deployment's prefix and performs the necessary deployments,
+// rollouts and cleanups until the context is cancelled. Once cancelled, any
+// running scripts are allowed to complete before the versions registered by
+// this deployment are removed and its hold on the agent's session released.
+//
+// All of the deployment's state is owned by a single event loop which
+// receives events from the agent's shared watches and task workers.
+// Requests to Consul which fail are retried, so Run only returns an error if
+// the deployment is unable to create a client with its configuration.
+func (d *Deployment) Run(ctx context.Context) error {
+	pattern, err := states.CompileVersionPattern(d.Config.VersionPattern)
 	if err != nil {
 		return err
 	}
 
-	defer session.Close()
+	d.pattern = pattern
 
-	d.session = session
+	store, err := openStore(path.Join(d.Config.Path, storeFile))
+	if err != nil {
+		d.err.Printf("could not read local state, starting afresh: %s\n", err)
+	}
 
-	go func() {
-		for version := range d.registerVersion {
-			go func() {
-				err := version.register()
-				if err != nil {
-					d.err.Printf("could not register {%s}: %s\n", version.ID, err)
-					d.ui.Error(fmt.Sprintf("[%s] version '%s' not registered: %s", d.Config.ID, version.ID, err))
-				}
-			}()
-		}
-	}()
+	d.store = store
 
-	go func() {
-		for version := range d.deployVersion {
-			if !version.exists() {
-				output, err := version.deploy()
-				if err != nil {
-					d.ui.Error(fmt.Sprintf("[%s] version '%s' deployment failed: %s", d.Config.ID, version.ID, err))
-				} else {
-					d.ui.Output(fmt.Sprintf("[%s] version '%s' deployed", d.Config.ID, version.ID))
-				}
-				d.ui.Info(output)
-			}
+	conn, err := d.shared.get(d.agentConfig.Name, d.Config.ClientConfig(&d.agentConfig.Config))
+	if err != nil {
+		return err
+	}
 
-			// Rollout this version since it has only been deployed now
-			if version.ID == d.currentVersion() {
-				d.rolloutVersion <- version
-			}
-		}
-	}()
+	defer d.shared.release(conn)
 
-	go func() {
-		for version := range d.rolloutVersion {
-			output, err := version.rollout()
-			if err != nil {
-				d.ui.Error(fmt.Sprintf("[%s] version '%s' rollout failed: %s", d.Config.ID, version.ID, err))
-			}
+	d.conn = conn
+	d.client = conn.client
 
-			d.ui.Info(output)
+	session := conn.acquireSession(ctx, d)
+	if session == nil {
+		return nil
+	}
 
-			for _, otherVersion := range d.versions {
-				if otherVersion != version && otherVersion.exists() {
-					otherVersion.setState("available", true)
-				}
-			}
-		}
-	}()
+	defer conn.releaseSession()
 
-	go func() {
-		for version := range d.cleanVersion {
-			output, err := version.clean()
-			if err != nil {
-				d.ui.Error(fmt.Sprintf("[%s] version '%s' cleanup failed: %s", d.Config.ID, version.ID, err))
-			} else {
-				d.ui.Output(fmt.Sprintf("[%s] version '%s' removed", d.Config.ID, version.ID))
-			}
-			d.ui.Info(output)
-		}
-	}()
+	d.session = session
+	d.versions = map[string]*Version{}
+	d.released = map[string]*Version{}
+	d.machine = newMachine(d.currentVersion(), d.localState, d.validVersion)
 
-	doneCh := make(chan struct{}, 2)
+	shutdownCh := ctx.Done()
 
-	go func() {
-		err := d.watchCurrentVersion()
-		if err != nil {
-			d.ui.Error(fmt.Sprintf("[%s] crashed: %s", d.Config.ID, err))
-		}
-		doneCh <- struct{}{}
-	}()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
+	d.registrations.Add(1)
 	go func() {
-		err := d.watchVersions()
-		if err != nil {
-			d.ui.Error(fmt.Sprintf("[%s] crashed: %s", d.Config.ID, err))
-		}
-		doneCh <- struct{}{}
+		defer d.registrations.Done()
+		d.registerNode(ctx)
 	}()
 
-	go func() {
+	unsubscribe := conn.subscribe(ctx, d)
+
+	for stopping := false; !stopping || !d.machine.idle(); {
 		select {
-		case <-util.MakeShutdownCh():
-			close(d.deployVersion)
-			close(d.rolloutVersion)
-			close(d.cleanVersion)
-			close(d.registerVersion)
+		case e := <-d.events:
+			d.apply(d.machine.handle(e))
+		case <-shutdownCh:
+			// The running tasks are left to complete, but nothing new is
+			// started once the deployment is shutting down.
+			shutdownCh = nil
+			stopping = true
+			cancel()
+			d.machine.stop()
 		}
-	}()
+	}
+
+	unsubscribe()
+
+	for _, version := range d.versions {
+		version.shutdown()
+	}
+
+	d.registrations.Wait()
 
-	<-doneCh
-	<-doneCh
 	return nil
 }
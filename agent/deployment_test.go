@@ -1,7 +1,12 @@
 package agent
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/EMSSConsulting/Depro/states"
 )
 
 func TestDeployment_FullPath(t *testing.T) {
@@ -36,6 +41,87 @@ func TestDeployment_VersionPrefix(t *testing.T) {
 	}
 
 	if d.versionPrefix("1234") != "deploy/myapp/1234" {
-		t.Fatalf("Expected versionPrefix('%s') to be 'deploy/myapp/1234', got '%s'", d.versionPrefix("1234"))
+		t.Fatalf("Expected versionPrefix('%s') to be 'deploy/myapp/1234', got '%s'", "1234", d.versionPrefix("1234"))
+	}
+}
+
+func TestDeployment_Reconfigure(t *testing.T) {
+	config := &DeploymentConfig{
+		ID:     "test",
+		Path:   "/data/deploy",
+		Prefix: "deploy/myapp",
+		Deploy: []string{"echo deploy"},
+	}
+
+	d := Deployment{
+		Config: config,
+		live:   config,
+	}
+
+	updated := *config
+	updated.Deploy = []string{"echo updated"}
+
+	if err := d.Reconfigure(&updated); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if d.settings().Deploy[0] != "echo updated" {
+		t.Fatalf("Expected deploy script to be updated, got '%s'", d.settings().Deploy[0])
+	}
+
+	moved := updated
+	moved.Path = "/data/other"
+
+	if err := d.Reconfigure(&moved); err == nil {
+		t.Fatal("Expected path change to require a restart")
+	}
+
+	if d.settings().Path != "/data/deploy" {
+		t.Fatalf("Expected path to be unchanged, got '%s'", d.settings().Path)
+	}
+
+	reconnected := updated
+	reconnected.Consul = &ConsulConfig{Datacenter: "dc2"}
+
+	if err := d.Reconfigure(&reconnected); err == nil {
+		t.Fatal("Expected Consul connection change to require a restart")
+	}
+}
+
+func TestVersion_RecreateDirectory_Invalid(t *testing.T) {
+	root, err := ioutil.TempDir("", "depro")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	pattern, err := states.CompileVersionPattern("")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	d := &Deployment{
+		Config:  &DeploymentConfig{ID: "test", Path: filepath.Join(root, "deploy")},
+		pattern: pattern,
+	}
+
+	outside := filepath.Join(root, "outside")
+	if err := os.Mkdir(outside, os.ModePerm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, id := range []string{"..", "../outside"} {
+		v := &Version{ID: id, deployment: d}
+		if err := v.recreateDirectory(); err == nil {
+			t.Fatalf("Expected version '%s' to be rejected", id)
+		}
+
+		if err := v.removeDirectory(); err == nil {
+			t.Fatalf("Expected version '%s' to be rejected", id)
+		}
+	}
+
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("Expected directory outside the deployment to be untouched, got '%s'", err)
 	}
 }
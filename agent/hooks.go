@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"strings"
+	"time"
+
+	"github.com/EMSSConsulting/Depro/states"
+)
+
+const (
+	// HookAbort fails the phase running a hook when the hook fails, this is
+	// the default policy.
+	HookAbort = "abort"
+	// HookWarn logs a warning when a hook fails and carries on with the rest
+	// of its phase.
+	HookWarn = "warn"
+)
+
+// hookPolicies are the supported values of HookConfig.Policy.
+var hookPolicies = []string{"", HookAbort, HookWarn}
+
+// HookConfig describes a script run before or after one of a deployment's
+// phases, or once one of them has failed.
+type HookConfig struct {
+	Script []string `json:"script"`
+	Policy string   `json:"policy"`
+}
+
+// hookNames are the names of a deployment's hooks, in the order in which
+// their problems are reported.
+var hookNames = []string{"preDeploy", "postDeploy", "preRollout", "postRollout", "preClean", "onFailure"}
+
+// hooks returns the deployment's hooks by name.
+func (d *DeploymentConfig) hooks() map[string]*HookConfig {
+	return map[string]*HookConfig{
+		"preDeploy":   d.PreDeploy,
+		"postDeploy":  d.PostDeploy,
+		"preRollout":  d.PreRollout,
+		"postRollout": d.PostRollout,
+		"preClean":    d.PreClean,
+		"onFailure":   d.OnFailure,
+	}
+}
+
+// step is a script run as part of a phase, either one of the deployment's
+// scripts or one of its hooks.
+type step struct {
+	name   string
+	script []string
+	policy string
+}
+
+func hookStep(name string, hook *HookConfig) step {
+	if hook == nil {
+		return step{name: name}
+	}
+
+	return step{name: name, script: hook.Script, policy: hook.Policy}
+}
+
+// steps returns the steps run by a phase, in the order they are run. The
+// scripts of the clean phase are allowed to fail, while its hook is not.
+func (d *DeploymentConfig) steps(phase taskKind) []step {
+	switch phase {
+	case deployTask:
+		return []step{
+			hookStep("preDeploy", d.PreDeploy),
+			{name: "deploy", script: d.Deploy, policy: HookAbort},
+			hookStep("postDeploy", d.PostDeploy),
+		}
+	case rolloutTask:
+		return []step{
+			hookStep("preRollout", d.PreRollout),
+			{name: "rollout", script: d.Rollout, policy: HookAbort},
+			hookStep("postRollout", d.PostRollout),
+		}
+	case cleanTask:
+		return []step{
+			hookStep("preClean", d.PreClean),
+			{name: "clean", script: d.Clean, policy: HookWarn},
+		}
+	}
+
+	return nil
+}
+
+// scriptOutput is the output of a single step of a phase.
+type scriptOutput struct {
+	Step   string
+	Output string
+}
+
+// runSteps runs each of a phase's steps in order, stopping at the first
+// which fails under the abort policy and returning its error, in which case
+// the step is left in the context. The output of every step which ran is
+// returned separately.
+func (v *Version) runSteps(config *DeploymentConfig, steps []step, run *scriptContext) ([]scriptOutput, error) {
+	outputs := []scriptOutput{}
+
+	for _, s := range steps {
+		if len(s.script) == 0 {
+			continue
+		}
+
+		run.Step = s.name
+		output, err := v.runScript(config, s.script, run)
+		outputs = append(outputs, scriptOutput{Step: s.name, Output: output})
+		if err == nil {
+			continue
+		}
+
+		if strings.EqualFold(s.policy, HookWarn) {
+			v.log.Printf("%s failed, continuing: %s\n", s.name, err)
+			continue
+		}
+
+		return outputs, err
+	}
+
+	return outputs, nil
+}
+
+// fail publishes the failure of the context's step and then runs the
+// deployment's onFailure hook, which is told the phase, step and exit code
+// which failed through its environment. The hook's output is added to the
+// phase's outputs, while its own failure is only logged.
+func (v *Version) fail(config *DeploymentConfig, run *scriptContext, started time.Time, err error, outputs []scriptOutput) []scriptOutput {
+	v.finishStep(run.Phase, run.Step, started, states.Failed, err)
+
+	if config.OnFailure == nil || len(config.OnFailure.Script) == 0 {
+		return outputs
+	}
+
+	run.Failure = &failureContext{
+		Phase:    run.Phase,
+		Step:     run.Step,
+		ExitCode: exitCode(err),
+		Error:    err.Error(),
+	}
+	run.Step = "onFailure"
+
+	output, err := v.runScript(config, config.OnFailure.Script, run)
+	outputs = append(outputs, scriptOutput{Step: "onFailure", Output: output})
+	if err != nil {
+		v.log.Printf("onFailure failed: %s\n", err)
+	}
+
+	return outputs
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/EMSSConsulting/Depro/common"
+	"github.com/EMSSConsulting/Depro/states"
+)
+
+func TestDecodeConfig_Hooks(t *testing.T) {
+	input := `{
+		"templates": {
+			"service": {"preRollout": {"script": ["drain ${id}"], "policy": "warn"}}
+		},
+		"deployments": [
+			{"id": "api", "path": "/data/api", "prefix": "api", "extends": "service"}
+		]
+	}`
+
+	config, err := DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if problems := config.resolveTemplates(config.Deployments); len(problems) > 0 {
+		t.Fatalf("err: %s", problems)
+	}
+
+	hook := config.Deployments[0].PreRollout
+	if hook == nil || len(hook.Script) != 1 || hook.Script[0] != "drain api" || hook.Policy != HookWarn {
+		t.Fatalf("bad preRollout hook, got %#v", hook)
+	}
+
+	if config.Templates["service"].PreRollout.Script[0] != "drain ${id}" {
+		t.Fatalf("bad template hook, got '%s'", config.Templates["service"].PreRollout.Script[0])
+	}
+}
+
+func TestConfig_Validate_Hooks(t *testing.T) {
+	config := Config{
+		Deployments: []DeploymentConfig{
+			{
+				ID:         "api",
+				Path:       "/data/deploy/api",
+				Prefix:     "api/version",
+				PostDeploy: &HookConfig{Script: []string{"warm"}, Policy: "retry"},
+			},
+		},
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("expected an unknown hook policy to be rejected")
+	}
+
+	problems := err.(common.Problems)
+	if len(problems) != 1 || problems[0].Field != "deployments[0].postDeploy.policy" {
+		t.Fatalf("bad problems, got:\n%s", problems)
+	}
+}
+
+func TestVersion_Fail(t *testing.T) {
+	v := testVersion()
+	run := &scriptContext{Phase: string(deployTask), Step: "preDeploy"}
+
+	v.fail(&DeploymentConfig{}, run, time.Now(), errors.New("hook failed"), nil)
+
+	record := v.lastRecord
+	if record.State != states.Failed || record.Phase != "deploy" || record.Step != "preDeploy" {
+		t.Fatalf("bad record, got %#v", record)
+	}
+
+	if reason := record.Reason(); reason != "preDeploy: hook failed" {
+		t.Fatalf("bad reason, got '%s', expected '%s'", reason, "preDeploy: hook failed")
+	}
+}
+
+func TestDeploymentConfig_Steps(t *testing.T) {
+	config := DeploymentConfig{
+		Deploy:      []string{"deploy"},
+		Rollout:     []string{"rollout"},
+		PreRollout:  &HookConfig{Script: []string{"drain"}},
+		PostRollout: &HookConfig{Script: []string{"undrain"}, Policy: HookWarn},
+	}
+
+	steps := config.steps(rolloutTask)
+	expected := []string{"preRollout", "rollout", "postRollout"}
+	if len(steps) != len(expected) {
+		t.Fatalf("bad steps, got %d, expected %d", len(steps), len(expected))
+	}
+
+	for i, name := range expected {
+		if steps[i].name != name {
+			t.Fatalf("bad step %d, got '%s', expected '%s'", i, steps[i].name, name)
+		}
+	}
+
+	if steps[2].policy != HookWarn {
+		t.Fatalf("bad policy, got '%s', expected '%s'", steps[2].policy, HookWarn)
+	}
+
+	if steps := config.steps(cleanTask); steps[1].policy != HookWarn {
+		t.Fatalf("bad clean policy, got '%s', expected '%s'", steps[1].policy, HookWarn)
+	}
+}
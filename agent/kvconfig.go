@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/EMSSConsulting/Depro/common"
+	"github.com/EMSSConsulting/Depro/util"
+	"github.com/hashicorp/consul/api"
+	"github.com/mitchellh/cli"
+)
+
+// configKVTimeout bounds the time taken to load the deployments stored in
+// Consul, so that an unreachable Consul agent is reported rather than
+// blocking the agent or the config command forever.
+var configKVTimeout = 30 * time.Second
+
+// kvSource returns the source recorded for a deployment read from a key.
+func kvSource(key string) string {
+	return fmt.Sprintf("consul:%s", key)
+}
+
+// ReadConfigKV reads the deployments stored beneath the configuration's
+// ConfigKV prefix in Consul, using its consistency mode. Each key holds the
+// configuration of a single deployment, in JSON or in HCL or YAML if the key
+// ends with their extension, and deployments without an id are named after
+// their key. A non-zero wait index blocks until the keys have changed, and
+// the index of the keys read is returned with them.
+func ReadConfigKV(ctx context.Context, config *Config, client *api.Client, waitIndex uint64) ([]DeploymentConfig, uint64, error) {
+	kv := client.KV()
+	prefix := fmt.Sprintf("%s/", strings.TrimSuffix(config.ConfigKV, "/"))
+
+	q := config.QueryOptions()
+	q.WaitIndex = waitIndex
+
+	var pairs api.KVPairs
+	meta, err := config.Read(q.WithContext(ctx), func(q *api.QueryOptions) (meta *api.QueryMeta, err error) {
+		pairs, meta, err = kv.List(prefix, q)
+		return meta, err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	deployments := []DeploymentConfig{}
+	problems := common.Problems{}
+
+	for _, pair := range pairs {
+		if strings.HasSuffix(pair.Key, "/") || len(bytes.TrimSpace(pair.Value)) == 0 {
+			continue
+		}
+
+		source := kvSource(pair.Key)
+
+		var deployment DeploymentConfig
+		fields, err := common.Decode(bytes.NewReader(pair.Value), common.FileFormat(pair.Key), &deployment)
+		if err != nil {
+			problems = append(problems, common.AsProblems(err).InFile(source)...)
+			continue
+		}
+
+		if deployment.ID == "" {
+			name := path.Base(pair.Key)
+			if common.FormatOf(name) != "" {
+				name = strings.TrimSuffix(name, path.Ext(name))
+			}
+
+			deployment.ID = name
+			fields = append(fields, "id")
+		}
+
+		deployment.setFields(fields)
+
+		deployment.source = source
+		deployment.index = -1
+
+		deployments = append(deployments, deployment)
+	}
+
+	return deployments, meta.LastIndex, problems.Err()
+}
+
+// LoadConfigKV adds the deployments stored beneath the configuration's
+// ConfigKV prefix, if it has one, to those already in the configuration.
+// The configuration's templates are applied to them as they would be to
+// deployments read from files. It gives up if Consul does not respond within
+// configKVTimeout.
+func LoadConfigKV(ctx context.Context, config *Config) error {
+	if config.ConfigKV == "" {
+		return nil
+	}
+
+	client, err := config.GetAPIClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, configKVTimeout)
+	defer cancel()
+
+	deployments, _, err := ReadConfigKV(ctx, config, client, 0)
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Error reading deployments from '%s': Consul did not respond within %s", config.ConfigKV, configKVTimeout)
+	} else if _, ok := err.(common.Problems); err != nil && !ok {
+		return fmt.Errorf("Error reading deployments from '%s': %s", config.ConfigKV, err)
+	}
+
+	problems := common.AsProblems(err)
+	problems = append(problems, config.resolveTemplates(deployments)...)
+
+	config.Deployments = append(config.Deployments, deployments...)
+
+	return problems.Err()
+}
+
+// WatchConfigKV watches the keys beneath the configuration's ConfigKV prefix
+// until the context is cancelled, calling changed whenever they are modified.
+func WatchConfigKV(ctx context.Context, ui cli.Ui, config *Config, changed func()) {
+	if config.ConfigKV == "" {
+		return
+	}
+
+	client, err := config.GetAPIClient()
+	if err != nil {
+		ui.Error(fmt.Sprintf("Failed to watch deployments in '%s': %s", config.ConfigKV, err))
+		return
+	}
+
+	backoff := util.Backoff{Min: retryMinDelay, Max: retryMaxDelay}
+	lastIndex := uint64(0)
+	lastQuery := time.Time{}
+
+	for {
+		if !util.Sleep(ctx, watchMinInterval-time.Since(lastQuery)) {
+			return
+		}
+
+		lastQuery = time.Now()
+		_, index, err := ReadConfigKV(ctx, config, client, lastIndex)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Problems with the keys themselves are reported once they are
+		// loaded, only failures to read them are handled here.
+		if _, ok := err.(common.Problems); err != nil && !ok {
+			delay := backoff.Next()
+			ui.Error(fmt.Sprintf("Failed to watch deployments in '%s', retrying in %s: %s", config.ConfigKV, delay, err))
+
+			if !util.Sleep(ctx, delay) {
+				return
+			}
+
+			continue
+		}
+
+		backoff.Reset()
+
+		if lastIndex != 0 && index != lastIndex {
+			changed()
+		}
+
+		// Start again from scratch if Consul's index goes backwards.
+		if index < lastIndex {
+			index = 0
+		}
+
+		lastIndex = index
+	}
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EMSSConsulting/Depro/common"
+	"github.com/hashicorp/consul/api"
+)
+
+// testKVServer serves the given keys in response to Consul's KV list requests.
+func testKVServer(t *testing.T, pairs api.KVPairs) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/depro/roles/web/" {
+			t.Errorf("bad request path, got '%s'", r.URL.Path)
+		}
+
+		w.Header().Set("X-Consul-Index", "42")
+		json.NewEncoder(w).Encode(pairs)
+	}))
+}
+
+func TestReadConfigKV(t *testing.T) {
+	server := testKVServer(t, api.KVPairs{
+		{Key: "depro/roles/web/"},
+		{Key: "depro/roles/web/api", Value: []byte(`{"path": "/data/api", "prefix": "api/version"}`)},
+		{Key: "depro/roles/web/website.yml", Value: []byte("id: www\npath: /var/www\nprefix: www/version\n")},
+		{Key: "depro/roles/web/worker.hcl", Value: []byte("path = \"/data/worker\"\n")},
+	})
+	defer server.Close()
+
+	client, err := api.NewClient(&api.Config{Address: server.Listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config := &Config{
+		Config:   common.DefaultConfig(),
+		ConfigKV: "depro/roles/web",
+	}
+
+	deployments, index, err := ReadConfigKV(context.Background(), config, client, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if index != 42 {
+		t.Fatalf("bad index, got %d, expected %d", index, 42)
+	}
+
+	expected := []string{"api", "www", "worker"}
+	if len(deployments) != len(expected) {
+		t.Fatalf("bad deployments, got %d, expected %d", len(deployments), len(expected))
+	}
+
+	for i, id := range expected {
+		if deployments[i].ID != id {
+			t.Fatalf("bad deployment id, got '%s', expected '%s'", deployments[i].ID, id)
+		}
+	}
+
+	if deployments[2].Path != "/data/worker" {
+		t.Fatalf("bad path, got '%s', expected '%s'", deployments[2].Path, "/data/worker")
+	}
+
+	if deployments[0].File() != "consul:depro/roles/web/api" {
+		t.Fatalf("bad source, got '%s', expected '%s'", deployments[0].File(), "consul:depro/roles/web/api")
+	}
+}
+
+func TestLoadConfigKV(t *testing.T) {
+	server := testKVServer(t, api.KVPairs{
+		{Key: "depro/roles/web/api", Value: []byte(`{"extends": "service"}`)},
+		{Key: "depro/roles/web/broken", Value: []byte(`{"paths": "/data/broken"}`)},
+	})
+	defer server.Close()
+
+	config := &Config{
+		Config: common.Config{
+			Server: server.Listener.Addr().String(),
+		},
+		ConfigKV: "depro/roles/web/",
+		Templates: map[string]DeploymentConfig{
+			"service": {
+				Path:   "/data/${id}",
+				Prefix: "${id}/version",
+			},
+		},
+	}
+
+	err := LoadConfigKV(context.Background(), config)
+	problems := common.AsProblems(err)
+	if len(problems) != 1 {
+		t.Fatalf("bad problems, got %d, expected %d: %s", len(problems), 1, err)
+	}
+
+	if problems[0].String() != "consul:depro/roles/web/broken: paths: unknown field" {
+		t.Fatalf("bad problem, got '%s'", problems[0].String())
+	}
+
+	if len(config.Deployments) != 1 {
+		t.Fatalf("bad deployments, got %d, expected %d", len(config.Deployments), 1)
+	}
+
+	api := config.Deployments[0]
+	if api.Path != "/data/api" || api.Prefix != "api/version" {
+		t.Fatalf("bad deployment, got path '%s' and prefix '%s'", api.Path, api.Prefix)
+	}
+
+	config.Deployments[0].Path = ""
+	problems = common.AsProblems(config.Validate())
+	if len(problems) != 1 || problems[0].String() != "consul:depro/roles/web/api: path: is required" {
+		t.Fatalf("bad validation problems, got '%s'", problems)
+	}
+}
+
+func TestLoadConfigKV_Timeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		configKVTimeout = timeout
+	}(configKVTimeout)
+	configKVTimeout = 50 * time.Millisecond
+
+	// The server never responds, as when Consul is unreachable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	config := &Config{
+		Config: common.Config{
+			Server: server.Listener.Addr().String(),
+		},
+		ConfigKV: "depro/roles/web",
+	}
+
+	err := LoadConfigKV(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), "did not respond") {
+		t.Fatalf("bad error, got '%v'", err)
+	}
+}
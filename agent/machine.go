@@ -0,0 +1,455 @@
+package agent
+
+import "github.com/EMSSConsulting/Depro/states"
+
+// taskKind identifies the script set run by a task.
+type taskKind string
+
+const (
+	deployTask  taskKind = "deploy"
+	rolloutTask taskKind = "rollout"
+	cleanTask   taskKind = "clean"
+)
+
+// task is a unit of work performed against a single version.
+type task struct {
+	Kind    taskKind
+	Version string
+}
+
+// event is delivered to a deployment's event loop by its watchers and
+// task workers.
+type event interface{}
+
+// versionsChanged is emitted when the list of versions under the
+// deployment's prefix changes.
+type versionsChanged struct {
+	Versions []string
+
+	// Skipped are the listed versions whose selectors do not match the
+	// agent's tags.
+	Skipped []string
+}
+
+// currentVersionChanged is emitted when the deployment's current version
+// key changes.
+type currentVersionChanged struct {
+	Version string
+}
+
+// taskCompleted is emitted by a task worker once it has finished running.
+type taskCompleted struct {
+	Task task
+	Err  error
+}
+
+// action is a side effect which the event loop must perform in response
+// to an event.
+type action interface{}
+
+// registerVersion starts publishing the local state of a version.
+type registerVersion struct {
+	Version string
+}
+
+// releaseVersion stops publishing the local state of a version.
+type releaseVersion struct {
+	Version string
+}
+
+// startTask runs a task in the background, which must be followed by a
+// taskCompleted event once it finishes.
+type startTask struct {
+	Task task
+}
+
+// publishState sets the published state of a registered version.
+type publishState struct {
+	Version string
+	State   states.State
+}
+
+// activateVersion records a version as the one currently rolled out on
+// the local node.
+type activateVersion struct {
+	Version string
+}
+
+// machine is the state machine driving a single deployment. It owns the
+// versions known to Consul and the local node, as well as the queue of
+// pending work, and turns events into the actions required to bring the
+// local node in line with Consul.
+// It is not safe for concurrent use, it is only ever accessed by the
+// deployment's event loop.
+type machine struct {
+	// local reports the state of a version on the local node as it was last
+	// recorded, Available once it has been deployed, Failed if it failed and
+	// Unregistered if it needs to be deployed.
+	local func(version string) states.State
+	// valid reports whether a version's ID may be deployed, invalid versions
+	// are registered so that their state can be reported but are never
+	// deployed, rolled out or cleaned up.
+	valid func(version string) bool
+
+	// versions are the versions currently listed in Consul, in the order
+	// in which they were first seen.
+	versions []string
+	// tracked are the versions registered by this agent.
+	tracked map[string]struct{}
+	// skipped are the listed versions whose selectors do not match the
+	// agent's tags, while refused are the tracked versions which were
+	// invalid or skipped when they were added and are never deployed.
+	skipped map[string]struct{}
+	refused map[string]struct{}
+	// desired is the current version as set in Consul.
+	desired string
+	// active is the version most recently rolled out on the local node.
+	active string
+
+	pending  []task
+	running  map[taskKind]string
+	stopping bool
+}
+
+func newMachine(active string, local func(version string) states.State, valid func(version string) bool) *machine {
+	return &machine{
+		local:   local,
+		valid:   valid,
+		tracked: map[string]struct{}{},
+		skipped: map[string]struct{}{},
+		refused: map[string]struct{}{},
+		active:  active,
+		running: map[taskKind]string{},
+	}
+}
+
+// handle applies an event to the state machine and returns the actions
+// which should be performed as a result, in order.
+func (m *machine) handle(e event) []action {
+	var actions []action
+
+	switch e := e.(type) {
+	case versionsChanged:
+		if m.stopping {
+			return nil
+		}
+
+		actions = m.versionsChanged(e.Versions, e.Skipped)
+	case currentVersionChanged:
+		if m.stopping {
+			return nil
+		}
+
+		actions = m.currentVersionChanged(e.Version)
+	case taskCompleted:
+		actions = m.taskCompleted(e.Task, e.Err)
+	}
+
+	return append(actions, m.schedule()...)
+}
+
+// stop prevents any further tasks from being started and discards the
+// queued ones, running tasks are still reported through handle.
+func (m *machine) stop() {
+	m.stopping = true
+	m.pending = nil
+}
+
+// idle reports whether no tasks are currently running.
+func (m *machine) idle() bool {
+	return len(m.running) == 0
+}
+
+func (m *machine) versionsChanged(versions, skipped []string) []action {
+	var actions []action
+
+	m.skipped = make(map[string]struct{}, len(skipped))
+	for _, id := range skipped {
+		m.skipped[id] = struct{}{}
+	}
+
+	newVersions := make(map[string]struct{}, len(versions))
+	for _, id := range versions {
+		newVersions[id] = struct{}{}
+	}
+
+	oldVersions := make(map[string]struct{}, len(m.versions))
+	known := m.versions[:0]
+	for _, id := range m.versions {
+		oldVersions[id] = struct{}{}
+
+		if _, exists := newVersions[id]; exists {
+			known = append(known, id)
+			continue
+		}
+
+		if _, tracked := m.tracked[id]; !tracked {
+			continue
+		}
+
+		// Refused versions were never deployed, so there is nothing to clean
+		if _, refused := m.refused[id]; refused {
+			delete(m.tracked, id)
+			delete(m.refused, id)
+			actions = append(actions, releaseVersion{Version: id})
+			continue
+		}
+
+		// Queued work for the version is dropped, it is cleaned up once any
+		// running task has completed.
+		m.cancel(id)
+		m.queue(cleanTask, id)
+	}
+	m.versions = known
+
+	for _, id := range versions {
+		if _, exists := oldVersions[id]; exists {
+			continue
+		}
+
+		m.versions = append(m.versions, id)
+		actions = append(actions, m.versionAdded(id)...)
+	}
+
+	return actions
+}
+
+func (m *machine) versionAdded(id string) []action {
+	actions := m.track(id)
+
+	// Any running or queued work will publish the version's state and
+	// decide what needs to happen next once it completes.
+	if m.busy(id) {
+		return actions
+	}
+
+	if refusal := m.refuse(id); refusal != "" {
+		return append(actions, publishState{Version: id, State: refusal})
+	}
+
+	switch {
+	case m.local(id) == states.Failed:
+		actions = append(actions, publishState{Version: id, State: states.Failed})
+	case m.local(id) == states.Unregistered:
+		m.queue(deployTask, id)
+	case id == m.desired && id != m.active:
+		m.queue(rolloutTask, id)
+	case id == m.desired:
+		actions = append(actions, publishState{Version: id, State: states.Active})
+	default:
+		actions = append(actions, publishState{Version: id, State: states.Available})
+	}
+
+	return actions
+}
+
+func (m *machine) currentVersionChanged(id string) []action {
+	if id == m.desired {
+		return nil
+	}
+
+	m.desired = id
+	if id == "" {
+		return nil
+	}
+
+	actions := m.track(id)
+
+	// Running or queued work will roll the version out once it completes
+	// since it is now the desired version.
+	if m.busy(id) {
+		return actions
+	}
+
+	if refusal := m.refuse(id); refusal != "" {
+		return append(actions, publishState{Version: id, State: refusal})
+	}
+
+	switch {
+	case m.local(id) == states.Failed:
+		actions = append(actions, publishState{Version: id, State: states.Failed})
+	case m.local(id) == states.Unregistered:
+		m.queue(deployTask, id)
+	case id != m.active:
+		m.queue(rolloutTask, id)
+	default:
+		actions = append(actions, publishState{Version: id, State: states.Active})
+	}
+
+	return actions
+}
+
+func (m *machine) taskCompleted(t task, err error) []action {
+	var actions []action
+
+	if m.running[t.Kind] == t.Version {
+		delete(m.running, t.Kind)
+	}
+
+	switch t.Kind {
+	case deployTask:
+		// A version removed while it was deploying is cleaned up instead
+		if err == nil && !m.stopping && t.Version == m.desired && t.Version != m.active && m.deployable(t.Version) {
+			m.queue(rolloutTask, t.Version)
+		}
+	case rolloutTask:
+		if err != nil {
+			break
+		}
+
+		m.active = t.Version
+		actions = append(actions, activateVersion{Version: t.Version})
+
+		for _, id := range m.versions {
+			if _, tracked := m.tracked[id]; !tracked || id == t.Version || m.busy(id) || m.local(id) != states.Available {
+				continue
+			}
+
+			actions = append(actions, publishState{Version: id, State: states.Available})
+		}
+	case cleanTask:
+		if _, tracked := m.tracked[t.Version]; tracked {
+			delete(m.tracked, t.Version)
+			actions = append(actions, releaseVersion{Version: t.Version})
+		}
+
+		// The version was added again while it was being cleaned up
+		if !m.stopping && m.listed(t.Version) {
+			actions = append(actions, m.versionAdded(t.Version)...)
+		}
+	}
+
+	return actions
+}
+
+// schedule starts as many queued tasks as possible, running at most one task
+// of each kind and one task per version at any time.
+func (m *machine) schedule() []action {
+	if m.stopping {
+		return nil
+	}
+
+	var actions []action
+
+	remaining := m.pending[:0]
+	for _, t := range m.pending {
+		if _, busy := m.running[t.Kind]; busy || m.runningVersion(t.Version) {
+			remaining = append(remaining, t)
+			continue
+		}
+
+		m.running[t.Kind] = t.Version
+		actions = append(actions, startTask{Task: t})
+	}
+	m.pending = remaining
+
+	return actions
+}
+
+// refuse returns the state published for a tracked version which is not
+// to be deployed on the local node, or an empty state if it is to be. Invalid
+// versions are always refused, while skipped versions are refused unless
+// they have already been deployed on the node. Refused versions remain so
+// until they are removed.
+func (m *machine) refuse(id string) states.State {
+	if !m.valid(id) {
+		m.refused[id] = struct{}{}
+		return states.Invalid
+	}
+
+	_, refused := m.refused[id]
+	_, skipped := m.skipped[id]
+	if refused || skipped && m.local(id) == states.Unregistered {
+		m.refused[id] = struct{}{}
+		return states.Skipped
+	}
+
+	return ""
+}
+
+func (m *machine) track(id string) []action {
+	if _, tracked := m.tracked[id]; tracked {
+		return nil
+	}
+
+	m.tracked[id] = struct{}{}
+	return []action{registerVersion{Version: id}}
+}
+
+// queue adds a task to the end of the queue unless it is already queued
+// or running.
+func (m *machine) queue(kind taskKind, id string) {
+	if m.scheduled(kind, id) {
+		return
+	}
+
+	m.pending = append(m.pending, task{Kind: kind, Version: id})
+}
+
+// cancel removes any queued deploys or rollouts for the given version.
+func (m *machine) cancel(id string) {
+	remaining := m.pending[:0]
+	for _, t := range m.pending {
+		if t.Version != id || t.Kind == cleanTask {
+			remaining = append(remaining, t)
+		}
+	}
+	m.pending = remaining
+}
+
+// scheduled reports whether a task is queued or running.
+func (m *machine) scheduled(kind taskKind, id string) bool {
+	if m.running[kind] == id {
+		return true
+	}
+
+	for _, t := range m.pending {
+		if t.Kind == kind && t.Version == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// busy reports whether any task is queued or running for the version.
+func (m *machine) busy(id string) bool {
+	if m.runningVersion(id) {
+		return true
+	}
+
+	for _, t := range m.pending {
+		if t.Version == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *machine) runningVersion(id string) bool {
+	for _, running := range m.running {
+		if running == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deployable reports whether a version is still tracked and listed, without
+// a clean queued or running for it.
+func (m *machine) deployable(id string) bool {
+	_, tracked := m.tracked[id]
+	return tracked && m.listed(id) && !m.scheduled(cleanTask, id)
+}
+
+func (m *machine) listed(id string) bool {
+	for _, known := range m.versions {
+		if known == id {
+			return true
+		}
+	}
+
+	return false
+}
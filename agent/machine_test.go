@@ -0,0 +1,404 @@
+package agent
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/EMSSConsulting/Depro/states"
+)
+
+type machineStep struct {
+	event   event
+	stop    bool
+	actions []action
+}
+
+func TestMachine(t *testing.T) {
+	failure := errors.New("script failed")
+
+	pattern, err := states.CompileVersionPattern("")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cases := []struct {
+		name     string
+		active   string
+		existing []string
+		failed   []string
+		steps    []machineStep
+		idle     bool
+	}{
+		{
+			name: "new version is deployed",
+			steps: []machineStep{
+				{
+					event:   versionsChanged{Versions: []string{"v1"}},
+					actions: []action{registerVersion{"v1"}, startTask{task{deployTask, "v1"}}},
+				},
+				{
+					event: taskCompleted{Task: task{deployTask, "v1"}},
+				},
+			},
+			idle: true,
+		},
+		{
+			name: "current version is deployed before it is rolled out",
+			steps: []machineStep{
+				{
+					event:   currentVersionChanged{Version: "v1"},
+					actions: []action{registerVersion{"v1"}, startTask{task{deployTask, "v1"}}},
+				},
+				{
+					event: versionsChanged{Versions: []string{"v1"}},
+				},
+				{
+					event:   taskCompleted{Task: task{deployTask, "v1"}},
+					actions: []action{startTask{task{rolloutTask, "v1"}}},
+				},
+				{
+					event:   taskCompleted{Task: task{rolloutTask, "v1"}},
+					actions: []action{activateVersion{"v1"}},
+				},
+			},
+			idle: true,
+		},
+		{
+			name: "failed deployment is not rolled out",
+			steps: []machineStep{
+				{
+					event:   currentVersionChanged{Version: "v1"},
+					actions: []action{registerVersion{"v1"}, startTask{task{deployTask, "v1"}}},
+				},
+				{
+					event: taskCompleted{Task: task{deployTask, "v1"}, Err: failure},
+				},
+			},
+			idle: true,
+		},
+		{
+			name:     "existing version is reported as available",
+			existing: []string{"v1"},
+			steps: []machineStep{
+				{
+					event:   versionsChanged{Versions: []string{"v1"}},
+					actions: []action{registerVersion{"v1"}, publishState{"v1", "available"}},
+				},
+			},
+			idle: true,
+		},
+		{
+			name:     "active version is not rolled out again",
+			active:   "v1",
+			existing: []string{"v1"},
+			steps: []machineStep{
+				{
+					event:   currentVersionChanged{Version: "v1"},
+					actions: []action{registerVersion{"v1"}, publishState{"v1", "active"}},
+				},
+				{
+					event:   versionsChanged{Versions: []string{"v1"}},
+					actions: []action{publishState{"v1", "active"}},
+				},
+			},
+			idle: true,
+		},
+		{
+			name:     "rollout marks other versions as available",
+			active:   "v1",
+			existing: []string{"v1", "v2"},
+			steps: []machineStep{
+				{
+					event:   versionsChanged{Versions: []string{"v1", "v2"}},
+					actions: []action{registerVersion{"v1"}, publishState{"v1", "available"}, registerVersion{"v2"}, publishState{"v2", "available"}},
+				},
+				{
+					event:   currentVersionChanged{Version: "v2"},
+					actions: []action{startTask{task{rolloutTask, "v2"}}},
+				},
+				{
+					event:   taskCompleted{Task: task{rolloutTask, "v2"}},
+					actions: []action{activateVersion{"v2"}, publishState{"v1", "available"}},
+				},
+			},
+			idle: true,
+		},
+		{
+			name:     "failed version is reported as failed",
+			existing: []string{"v1"},
+			failed:   []string{"v2"},
+			steps: []machineStep{
+				{
+					event:   versionsChanged{Versions: []string{"v1", "v2"}},
+					actions: []action{registerVersion{"v1"}, publishState{"v1", "available"}, registerVersion{"v2"}, publishState{"v2", "failed"}},
+				},
+				{
+					event:   currentVersionChanged{Version: "v2"},
+					actions: []action{publishState{"v2", "failed"}},
+				},
+			},
+			idle: true,
+		},
+		{
+			name:     "rollout does not mark failed versions as available",
+			existing: []string{"v1"},
+			failed:   []string{"v2"},
+			steps: []machineStep{
+				{
+					event:   versionsChanged{Versions: []string{"v1", "v2"}},
+					actions: []action{registerVersion{"v1"}, publishState{"v1", "available"}, registerVersion{"v2"}, publishState{"v2", "failed"}},
+				},
+				{
+					event:   currentVersionChanged{Version: "v1"},
+					actions: []action{startTask{task{rolloutTask, "v1"}}},
+				},
+				{
+					event:   taskCompleted{Task: task{rolloutTask, "v1"}},
+					actions: []action{activateVersion{"v1"}},
+				},
+			},
+			idle: true,
+		},
+		{
+			name:     "removed version is cleaned and released",
+			existing: []string{"v1"},
+			steps: []machineStep{
+				{
+					event:   versionsChanged{Versions: []string{"v1"}},
+					actions: []action{registerVersion{"v1"}, publishState{"v1", "available"}},
+				},
+				{
+					event:   versionsChanged{Versions: []string{}},
+					actions: []action{startTask{task{cleanTask, "v1"}}},
+				},
+				{
+					event:   taskCompleted{Task: task{cleanTask, "v1"}},
+					actions: []action{releaseVersion{"v1"}},
+				},
+			},
+			idle: true,
+		},
+		{
+			name: "version removed while deploying is cleaned afterwards",
+			steps: []machineStep{
+				{
+					event:   versionsChanged{Versions: []string{"v1"}},
+					actions: []action{registerVersion{"v1"}, startTask{task{deployTask, "v1"}}},
+				},
+				{
+					event: versionsChanged{Versions: []string{}},
+				},
+				{
+					event:   taskCompleted{Task: task{deployTask, "v1"}},
+					actions: []action{startTask{task{cleanTask, "v1"}}},
+				},
+				{
+					event:   taskCompleted{Task: task{cleanTask, "v1"}},
+					actions: []action{releaseVersion{"v1"}},
+				},
+			},
+			idle: true,
+		},
+		{
+			name: "current version removed while deploying is not rolled out",
+			steps: []machineStep{
+				{
+					event:   versionsChanged{Versions: []string{"v1"}},
+					actions: []action{registerVersion{"v1"}, startTask{task{deployTask, "v1"}}},
+				},
+				{
+					event: currentVersionChanged{Version: "v1"},
+				},
+				{
+					event: versionsChanged{Versions: []string{}},
+				},
+				{
+					event:   taskCompleted{Task: task{deployTask, "v1"}},
+					actions: []action{startTask{task{cleanTask, "v1"}}},
+				},
+				{
+					event:   taskCompleted{Task: task{cleanTask, "v1"}},
+					actions: []action{releaseVersion{"v1"}},
+				},
+			},
+			idle: true,
+		},
+		{
+			name:     "version added while cleaning is deployed again",
+			existing: []string{"v1"},
+			steps: []machineStep{
+				{
+					event:   versionsChanged{Versions: []string{"v1"}},
+					actions: []action{registerVersion{"v1"}, publishState{"v1", "available"}},
+				},
+				{
+					event:   versionsChanged{Versions: []string{}},
+					actions: []action{startTask{task{cleanTask, "v1"}}},
+				},
+				{
+					event: versionsChanged{Versions: []string{"v1"}},
+				},
+				{
+					event:   taskCompleted{Task: task{cleanTask, "v1"}},
+					actions: []action{releaseVersion{"v1"}, registerVersion{"v1"}, startTask{task{deployTask, "v1"}}},
+				},
+			},
+		},
+		{
+			name: "deployments of the same kind run one at a time",
+			steps: []machineStep{
+				{
+					event:   versionsChanged{Versions: []string{"v1", "v2"}},
+					actions: []action{registerVersion{"v1"}, registerVersion{"v2"}, startTask{task{deployTask, "v1"}}},
+				},
+				{
+					event:   taskCompleted{Task: task{deployTask, "v1"}},
+					actions: []action{startTask{task{deployTask, "v2"}}},
+				},
+				{
+					event: taskCompleted{Task: task{deployTask, "v2"}},
+				},
+			},
+			idle: true,
+		},
+		{
+			name:     "tasks of different kinds run concurrently",
+			existing: []string{"v1"},
+			steps: []machineStep{
+				{
+					event:   versionsChanged{Versions: []string{"v1", "v2"}},
+					actions: []action{registerVersion{"v1"}, publishState{"v1", "available"}, registerVersion{"v2"}, startTask{task{deployTask, "v2"}}},
+				},
+				{
+					event:   currentVersionChanged{Version: "v1"},
+					actions: []action{startTask{task{rolloutTask, "v1"}}},
+				},
+			},
+		},
+		{
+			name: "invalid versions are reported but never deployed",
+			steps: []machineStep{
+				{
+					event:   versionsChanged{Versions: []string{"v1", "bad version"}},
+					actions: []action{registerVersion{"v1"}, registerVersion{"bad version"}, publishState{"bad version", "invalid"}, startTask{task{deployTask, "v1"}}},
+				},
+				{
+					event:   currentVersionChanged{Version: "bad version"},
+					actions: []action{publishState{"bad version", "invalid"}},
+				},
+				{
+					event: taskCompleted{Task: task{deployTask, "v1"}},
+				},
+				{
+					event:   versionsChanged{Versions: []string{"v1"}},
+					actions: []action{releaseVersion{"bad version"}},
+				},
+			},
+			idle: true,
+		},
+		{
+			name:     "skipped versions are reported but never deployed",
+			existing: []string{"v0"},
+			steps: []machineStep{
+				{
+					event:   versionsChanged{Versions: []string{"v0", "v1", "v2"}, Skipped: []string{"v0", "v2"}},
+					actions: []action{registerVersion{"v0"}, publishState{"v0", "available"}, registerVersion{"v1"}, registerVersion{"v2"}, publishState{"v2", "skipped"}, startTask{task{deployTask, "v1"}}},
+				},
+				{
+					event:   currentVersionChanged{Version: "v2"},
+					actions: []action{publishState{"v2", "skipped"}},
+				},
+				{
+					event:   versionsChanged{Versions: []string{"v0", "v1"}},
+					actions: []action{releaseVersion{"v2"}},
+				},
+				{
+					event: taskCompleted{Task: task{deployTask, "v1"}},
+				},
+			},
+			idle: true,
+		},
+		{
+			name: "invalid current version is reported",
+			steps: []machineStep{
+				{
+					event:   currentVersionChanged{Version: "-rf"},
+					actions: []action{registerVersion{"-rf"}, publishState{"-rf", "invalid"}},
+				},
+			},
+			idle: true,
+		},
+		{
+			name: "stopping waits for running tasks and discards queued ones",
+			steps: []machineStep{
+				{
+					event:   versionsChanged{Versions: []string{"v1", "v2"}},
+					actions: []action{registerVersion{"v1"}, registerVersion{"v2"}, startTask{task{deployTask, "v1"}}},
+				},
+				{
+					stop: true,
+				},
+				{
+					event: currentVersionChanged{Version: "v1"},
+				},
+				{
+					event: taskCompleted{Task: task{deployTask, "v1"}},
+				},
+			},
+			idle: true,
+		},
+	}
+
+	for _, c := range cases {
+		local := map[string]states.State{}
+		for _, id := range c.existing {
+			local[id] = states.Available
+		}
+		for _, id := range c.failed {
+			local[id] = states.Failed
+		}
+
+		m := newMachine(c.active, func(id string) states.State {
+			if state, exists := local[id]; exists {
+				return state
+			}
+
+			return states.Unregistered
+		}, func(id string) bool {
+			return states.ValidateVersion(id, pattern) == nil
+		})
+
+		for i, step := range c.steps {
+			if step.stop {
+				m.stop()
+			}
+
+			if step.event == nil {
+				continue
+			}
+
+			if done, ok := step.event.(taskCompleted); ok {
+				switch {
+				case done.Task.Kind == cleanTask:
+					delete(local, done.Task.Version)
+				case done.Err != nil:
+					local[done.Task.Version] = states.Failed
+				case done.Task.Kind == deployTask:
+					local[done.Task.Version] = states.Available
+				}
+			}
+
+			actions := m.handle(step.event)
+			if len(actions) != 0 || len(step.actions) != 0 {
+				if !reflect.DeepEqual(actions, step.actions) {
+					t.Fatalf("%s: step %d: bad actions, got %#v, expected %#v", c.name, i, actions, step.actions)
+				}
+			}
+		}
+
+		if m.idle() != c.idle {
+			t.Fatalf("%s: bad idle state, got %v, expected %v", c.name, m.idle(), c.idle)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/EMSSConsulting/Depro/states"
+	"github.com/EMSSConsulting/Depro/util"
+	"github.com/EMSSConsulting/waiter"
+)
+
+// registerNode publishes the agent's registration, holding its tags, at
+// <prefix>/.nodes/<name> until the context is cancelled, at which point the
+// registration is removed. The registration is bound to the deployment's
+// session, so it is also removed if the agent stops without removing it.
+// Failed registrations are retried until the context is cancelled.
+func (d *Deployment) registerNode(ctx context.Context) {
+	value, err := states.Node{Tags: d.agentConfig.Tags}.Encode()
+	if err != nil {
+		d.err.Printf("could not encode node registration: %s\n", err)
+		return
+	}
+
+	// The registration is sent to each customer once it starts, and the
+	// channel is closed to stop the customer once the context is cancelled.
+	state := make(chan string)
+	resend := make(chan struct{}, 1)
+	resend <- struct{}{}
+
+	go func() {
+		defer close(state)
+
+		for {
+			select {
+			case <-resend:
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case state <- string(value):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	backoff := util.Backoff{Min: retryMinDelay, Max: retryMaxDelay}
+	for {
+		customer := waiter.NewCustomer(d.client, d.nodePrefix(), d.agentConfig.Name, state)
+		err := customer.Run(d.session)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+
+		delay := backoff.Next()
+		d.err.Printf("node registration failed, retrying in %s: %s\n", delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		select {
+		case resend <- struct{}{}:
+		default:
+		}
+	}
+
+	_, err = d.client.KV().Delete(fmt.Sprintf("%s/%s", d.nodePrefix(), d.agentConfig.Name), nil)
+	if err != nil {
+		d.err.Printf("could not remove node registration: %s\n", err)
+	}
+}
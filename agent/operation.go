@@ -1,47 +1,235 @@
 package agent
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"time"
 
 	"github.com/mitchellh/cli"
 )
 
+// ErrGracePeriodExceeded is returned by Operation.Run when deployments did not
+// finish shutting down within the configured grace period.
+var ErrGracePeriodExceeded = errors.New("deployments did not stop within the grace period")
+
 // Operation contains the configuration and clients for performing a deployment
 type Operation struct {
 	UI     cli.Ui
 	Config *Config
+
+	reloads     chan reloadRequest
+	done        chan struct{}
+	connections *connections
+
+	// The following are owned by Run.
+	running  map[string]*runningDeployment
+	restarts map[string]*DeploymentConfig
+	exitCh   chan deploymentExit
+}
+
+type reloadRequest struct {
+	config *Config
+	result chan error
+}
+
+type runningDeployment struct {
+	deployment *Deployment
+	stop       context.CancelFunc
+}
+
+type deploymentExit struct {
+	deployment *Deployment
+	err        error
 }
 
 func NewOperation(ui cli.Ui, config *Config) Operation {
 	return Operation{
-		Config: config,
-		UI:     ui,
+		Config:      config,
+		UI:          ui,
+		reloads:     make(chan reloadRequest),
+		done:        make(chan struct{}),
+		connections: newConnections(),
 	}
 }
 
-// Run executes the process for a deployment operation
-func (o *Operation) Run() error {
-	shutdownCh := make(chan struct{})
+// Run executes the process for a deployment operation until the provided
+// context is cancelled and all deployments have stopped. Deployments are
+// given the configured grace period to complete their running tasks once
+// the context has been cancelled.
+func (o *Operation) Run(ctx context.Context) error {
+	o.running = map[string]*runningDeployment{}
+	o.restarts = map[string]*DeploymentConfig{}
+	o.exitCh = make(chan deploymentExit)
+	defer close(o.done)
+
+	for i := range o.Config.Deployments {
+		o.start(ctx, &o.Config.Deployments[i])
+	}
 
-	for _, deployment := range o.Config.Deployments {
-		d := NewDeployment(o, &deployment)
+	var result error
+	var graceCh <-chan time.Time
+	shutdownCh := ctx.Done()
 
-		go func() {
-			o.UI.Info(fmt.Sprintf("[%s] starting", d.Config.ID))
-			err := d.Run()
-			if err != nil {
-				o.UI.Error(fmt.Sprintf("[%s] crashed: %s", d.Config.ID, err))
-			} else {
-				o.UI.Info(fmt.Sprintf("[%s] stopped", d.Config.ID))
+	for len(o.running) > 0 || (ctx.Err() == nil && result == nil) {
+		select {
+		case exit := <-o.exitCh:
+			if o.exited(ctx, exit) != nil && result == nil {
+				result = exit.err
+			}
+		case req := <-o.reloads:
+			if ctx.Err() != nil {
+				req.result <- errors.New("the agent is shutting down")
+				continue
 			}
 
-			shutdownCh <- struct{}{}
-		}()
+			req.result <- o.reload(ctx, req.config)
+		case <-shutdownCh:
+			shutdownCh = nil
+			graceCh = time.After(o.Config.GracePeriod)
+		case <-graceCh:
+			return ErrGracePeriodExceeded
+		}
+	}
+
+	return result
+}
+
+// Reload applies a new configuration to a running operation. Deployments which
+// are no longer present are stopped, new ones are started and the scripts of
+// existing ones are replaced without affecting their registered versions.
+// If the new configuration is invalid, it is rejected and the current one is
+// left running.
+func (o *Operation) Reload(config *Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	req := reloadRequest{
+		config: config,
+		result: make(chan error, 1),
+	}
+
+	select {
+	case o.reloads <- req:
+		return <-req.result
+	case <-o.done:
+		return errors.New("the agent has stopped")
+	}
+}
+
+func (o *Operation) reload(ctx context.Context, config *Config) error {
+	// The control endpoint is started once, and may be the one which
+	// requested the reload.
+	if config.ControlAddr != o.Config.ControlAddr {
+		return fmt.Errorf("controlAddr cannot be changed while the agent is running, restart it to listen on '%s'", config.ControlAddr)
+	}
+
+	// Changes to the agent's own settings affect every deployment.
+	restartAll := !o.Config.Config.Equal(&config.Config) || o.Config.Name != config.Name ||
+		!reflect.DeepEqual(o.Config.Tags, config.Tags)
+
+	// The grace period is read from the configuration when the agent is
+	// shut down, so it only needs to be replaced.
+	if config.GracePeriod != o.Config.GracePeriod {
+		o.UI.Info(fmt.Sprintf("Grace period changed from %s to %s", o.Config.GracePeriod, config.GracePeriod))
 	}
 
-	for range o.Config.Deployments {
-		<-shutdownCh
+	o.Config = config
+
+	configs := map[string]*DeploymentConfig{}
+	for i := range config.Deployments {
+		deployment := &config.Deployments[i]
+		configs[deployment.ID] = deployment
+	}
+
+	for id, running := range o.running {
+		if _, exists := configs[id]; !exists {
+			o.UI.Info(fmt.Sprintf("[%s] removed from configuration", id))
+			delete(o.restarts, id)
+			running.stop()
+		}
+	}
+
+	for id := range o.restarts {
+		if _, exists := configs[id]; !exists {
+			delete(o.restarts, id)
+		}
+	}
+
+	for id, deployment := range configs {
+		running, exists := o.running[id]
+		if !exists {
+			o.start(ctx, deployment)
+			continue
+		}
+
+		if restartAll || running.deployment.Reconfigure(deployment) != nil {
+			o.UI.Info(fmt.Sprintf("[%s] restarting to apply new configuration", id))
+			o.restarts[id] = deployment
+			running.stop()
+			continue
+		}
+
+		o.UI.Info(fmt.Sprintf("[%s] configuration updated", id))
 	}
 
 	return nil
 }
+
+// start runs a deployment in the background, or schedules it to be started
+// once a previous instance with the same ID has stopped.
+func (o *Operation) start(ctx context.Context, config *DeploymentConfig) {
+	if _, exists := o.running[config.ID]; exists {
+		o.restarts[config.ID] = config
+		return
+	}
+
+	d := NewDeployment(o, config)
+	dCtx, stop := context.WithCancel(ctx)
+
+	o.running[config.ID] = &runningDeployment{
+		deployment: d,
+		stop:       stop,
+	}
+
+	go func() {
+		o.UI.Info(fmt.Sprintf("[%s] starting", d.Config.ID))
+		err := d.Run(dCtx)
+		stop()
+
+		if err != nil {
+			o.UI.Error(fmt.Sprintf("[%s] crashed: %s", d.Config.ID, err))
+			err = fmt.Errorf("deployment '%s' crashed: %s", d.Config.ID, err)
+		} else {
+			o.UI.Info(fmt.Sprintf("[%s] stopped", d.Config.ID))
+		}
+
+		o.exitCh <- deploymentExit{
+			deployment: d,
+			err:        err,
+		}
+	}()
+}
+
+// exited handles a deployment which has stopped, starting its replacement if
+// it was stopped to apply a new configuration.
+func (o *Operation) exited(ctx context.Context, exit deploymentExit) error {
+	id := exit.deployment.Config.ID
+
+	if running, exists := o.running[id]; exists && running.deployment == exit.deployment {
+		delete(o.running, id)
+	}
+
+	if config, exists := o.restarts[id]; exists {
+		delete(o.restarts, id)
+
+		if ctx.Err() == nil {
+			o.start(ctx, config)
+			return nil
+		}
+	}
+
+	return exit.err
+}
@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/cli"
+)
+
+func TestOperation_Reload(t *testing.T) {
+	config := DefaultConfig()
+	config.ControlAddr = "127.0.0.1:8600"
+
+	var output bytes.Buffer
+	o := NewOperation(&cli.BasicUi{Writer: &output}, config)
+	o.running = map[string]*runningDeployment{}
+	o.restarts = map[string]*DeploymentConfig{}
+
+	moved := *config
+	moved.ControlAddr = "127.0.0.1:8601"
+	err := o.reload(context.Background(), &moved)
+	if err == nil || !strings.Contains(err.Error(), "controlAddr") {
+		t.Fatalf("bad error, got '%v'", err)
+	}
+
+	if o.Config != config {
+		t.Fatal("expected the rejected configuration not to be applied")
+	}
+
+	longer := *config
+	longer.GracePeriod = time.Minute
+	if err := o.reload(context.Background(), &longer); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if o.Config.GracePeriod != time.Minute {
+		t.Fatalf("bad grace period, got '%s', expected '%s'", o.Config.GracePeriod, time.Minute)
+	}
+
+	if !strings.Contains(output.String(), "Grace period changed") {
+		t.Fatalf("bad output, got '%s'", output.String())
+	}
+}
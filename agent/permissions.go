@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// defaultDirMode and defaultFileMode are the permissions given to version
+	// directories and agent managed files unless the deployment sets its own.
+	defaultDirMode  os.FileMode = 0755
+	defaultFileMode os.FileMode = 0644
+
+	// privateFileMode is the permissions given to files which only the agent
+	// reads, such as a deployment's local state.
+	privateFileMode os.FileMode = 0600
+)
+
+// parseMode reads a permission mode written in octal, such as "0750".
+func parseMode(value string, fallback os.FileMode) (os.FileMode, error) {
+	if value == "" {
+		return fallback, nil
+	}
+
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode '%s', expected an octal permission such as 0755", value)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// dirMode returns the permissions given to the deployment's version
+// directories.
+func (d *DeploymentConfig) dirMode() os.FileMode {
+	mode, err := parseMode(d.DirMode, defaultDirMode)
+	if err != nil {
+		return defaultDirMode
+	}
+
+	return mode
+}
+
+// fileMode returns the permissions given to the files written by the agent
+// into the deployment's path.
+func (d *DeploymentConfig) fileMode() os.FileMode {
+	mode, err := parseMode(d.FileMode, defaultFileMode)
+	if err != nil {
+		return defaultFileMode
+	}
+
+	return mode
+}
+
+// ownership resolves the deployment's owner and group to the IDs which own
+// its directories and files, either of which is -1 when it is not set.
+func (d *DeploymentConfig) ownership() (int, int, error) {
+	uid, gid := -1, -1
+
+	if d.Owner != "" {
+		u, err := lookupUser(d.Owner)
+		if err != nil {
+			return -1, -1, err
+		}
+
+		uid, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return -1, -1, fmt.Errorf("user '%s' does not have a numeric ID", d.Owner)
+		}
+	}
+
+	if d.Group != "" {
+		g, err := user.LookupGroup(d.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(d.Group); err != nil {
+				return -1, -1, fmt.Errorf("unknown group '%s'", d.Group)
+			}
+		}
+
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return -1, -1, fmt.Errorf("group '%s' does not have a numeric ID", d.Group)
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// lookupUser finds a user by name or, failing that, by ID.
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+
+	if u, err = user.LookupId(name); err != nil {
+		return nil, fmt.Errorf("unknown user '%s'", name)
+	}
+
+	return u, nil
+}
+
+// chownToUser gives a file to a user and their primary group.
+func chownToUser(path, name string) error {
+	u, err := lookupUser(name)
+	if err != nil {
+		return err
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("user '%s' does not have a numeric ID", name)
+	}
+
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("user '%s' does not have a numeric group ID", name)
+	}
+
+	return os.Chown(path, uid, gid)
+}
+
+// makeDirectory creates a directory, and any missing parents, giving the
+// directory itself the deployment's permissions and ownership.
+func (d *DeploymentConfig) makeDirectory(path string) error {
+	if err := os.MkdirAll(path, d.dirMode()); err != nil {
+		return err
+	}
+
+	return d.applyPermissions(path, d.dirMode())
+}
+
+// writeFile writes a file with the deployment's permissions and ownership.
+func (d *DeploymentConfig) writeFile(path string, contents []byte) error {
+	return replaceFile(path, contents, func(name string) error {
+		return d.applyPermissions(name, d.fileMode())
+	})
+}
+
+// writePrivateFile writes a file which only the agent's user may read,
+// leaving it owned by that user.
+func writePrivateFile(path string, contents []byte) error {
+	return replaceFile(path, contents, func(name string) error {
+		return os.Chmod(name, privateFileMode)
+	})
+}
+
+// replaceFile writes a file to a temporary file alongside it, which is
+// synced and given its permissions by prepare before replacing it, so the
+// file is never left partially written.
+func replaceFile(path string, contents []byte, prepare func(name string) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+
+	name := f.Name()
+
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = prepare(name)
+	}
+	if err == nil {
+		err = os.Rename(name, path)
+	}
+
+	if err != nil {
+		os.Remove(name)
+		return err
+	}
+
+	syncDirectory(filepath.Dir(path))
+	return nil
+}
+
+// syncDirectory flushes a directory's entries to disk, so that a file which
+// has been renamed into it survives a crash. Not every platform supports
+// this, so it is done on a best effort basis.
+func syncDirectory(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	dir.Sync()
+}
+
+// applyPermissions sets the mode of a path, which is otherwise limited by
+// the agent's umask, and its owner and group when they are configured.
+func (d *DeploymentConfig) applyPermissions(path string, mode os.FileMode) error {
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+
+	uid, gid, err := d.ownership()
+	if err != nil {
+		return err
+	}
+
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+
+	return os.Chown(path, uid, gid)
+}
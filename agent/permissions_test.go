@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected os.FileMode
+		valid    bool
+	}{
+		{"", defaultDirMode, true},
+		{"0750", 0750, true},
+		{"640", 0640, true},
+		{"0778", 0, false},
+		{"01777", 0, false},
+		{"rwxr-x---", 0, false},
+	}
+
+	for _, c := range cases {
+		mode, err := parseMode(c.value, defaultDirMode)
+		if (err == nil) != c.valid {
+			t.Fatalf("bad validation of '%s', got '%v'", c.value, err)
+		}
+
+		if c.valid && mode != c.expected {
+			t.Fatalf("bad mode for '%s', got '%o', expected '%o'", c.value, mode, c.expected)
+		}
+	}
+}
+
+func TestDeploymentConfig_Permissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are not supported on Windows")
+	}
+
+	root, err := ioutil.TempDir("", "depro")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	config := &DeploymentConfig{DirMode: "0750", FileMode: "0640"}
+
+	dir := filepath.Join(root, "v1")
+	if err := config.makeDirectory(dir); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0750 {
+		t.Fatalf("bad directory mode, got '%v' (%v), expected '%o'", info.Mode().Perm(), err, 0750)
+	}
+
+	file := filepath.Join(root, "current")
+	if err := config.writeFile(file, []byte("v1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0640 {
+		t.Fatalf("bad file mode, got '%v' (%v), expected '%o'", info.Mode().Perm(), err, 0640)
+	}
+
+	state := filepath.Join(root, storeFile)
+	if err := writePrivateFile(state, []byte("{}")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if info, err := os.Stat(state); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("bad private file mode, got '%v' (%v), expected '%o'", info.Mode().Perm(), err, 0600)
+	}
+
+	config.Owner = "depro-missing-user"
+	if err := config.writeFile(file, []byte("v2")); err == nil {
+		t.Fatal("expected an unknown owner to be rejected")
+	}
+}
@@ -0,0 +1,64 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// runAs runs a script with the given shell as another user, in the given
+// directory and with the given environment added to the agent's own. The
+// script stops at the first line which fails, and its combined output is
+// returned.
+func runAs(username, shell, directory string, environment map[string]string, script []string) ([]byte, error) {
+	u, err := lookupUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user '%s' does not have a numeric ID", username)
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user '%s' does not have a numeric group ID", username)
+	}
+
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if group, err := strconv.ParseUint(id, 10, 32); err == nil {
+				credential.Groups = append(credential.Groups, uint32(group))
+			}
+		}
+	}
+
+	switch strings.ToLower(shell) {
+	case "", "sh":
+		shell = "sh"
+	case "bash":
+		shell = "bash"
+	default:
+		return nil, fmt.Errorf("scripts can only be run as another user with the sh or bash shells, not '%s'", shell)
+	}
+
+	cmd := exec.Command(shell, "-c", strings.Join(append([]string{"set -e"}, script...), "\n"))
+	cmd.Dir = directory
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+
+	cmd.Env = os.Environ()
+	for name, value := range environment {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", name, value))
+	}
+	cmd.Env = append(cmd.Env, "HOME="+u.HomeDir, "USER="+u.Username, "LOGNAME="+u.Username)
+
+	return cmd.CombinedOutput()
+}
@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"os"
+	"os/user"
+	"strings"
+	"testing"
+)
+
+func TestRunAs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("running scripts as another user requires root")
+	}
+
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no 'nobody' user to run scripts as")
+	}
+
+	output, err := runAs("nobody", "sh", os.TempDir(), map[string]string{"VERSION": "v1"}, []string{
+		"id -u",
+		"echo $VERSION",
+	})
+	if err != nil {
+		t.Fatalf("err: %s (%s)", err, output)
+	}
+
+	expected := nobody.Uid + "\nv1\n"
+	if string(output) != expected {
+		t.Fatalf("bad output, got '%s', expected '%s'", output, expected)
+	}
+
+	output, err = runAs("nobody", "sh", os.TempDir(), nil, []string{
+		"echo before",
+		"false",
+		"echo after",
+	})
+	if err == nil {
+		t.Fatal("expected a failing line to fail the script")
+	}
+
+	if string(output) != "before\n" {
+		t.Fatalf("bad output, got '%s', expected '%s'", output, "before\n")
+	}
+
+	if _, err := runAs("nobody", "powershell", os.TempDir(), nil, []string{"exit 0"}); err == nil || !strings.Contains(err.Error(), "powershell") {
+		t.Fatalf("bad error for unsupported shell, got '%v'", err)
+	}
+}
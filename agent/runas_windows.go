@@ -0,0 +1,9 @@
+package agent
+
+import "fmt"
+
+// runAs is not supported on Windows, where scripts are always run as the
+// agent's user.
+func runAs(username, shell, directory string, environment map[string]string, script []string) ([]byte, error) {
+	return nil, fmt.Errorf("scripts cannot be run as user '%s' on Windows", username)
+}
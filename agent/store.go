@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/EMSSConsulting/Depro/states"
+)
+
+// storeFile is the name of the file within a deployment's path which holds
+// its local state. Version IDs may not begin with a ".", so it can never be
+// mistaken for a version.
+const storeFile = ".depro-state.json"
+
+// localState is the state of a deployment on the local node, which is kept
+// across restarts of the agent.
+type localState struct {
+	// Current is the version most recently rolled out on the local node.
+	Current  string                   `json:"current"`
+	Versions map[string]*localVersion `json:"versions"`
+}
+
+// localVersion is the recorded state of a single version on the local node.
+type localVersion struct {
+	// Record is the most recent record published for the version.
+	Record states.Record `json:"record"`
+
+	// Deployed is when the version was last deployed successfully and
+	// Checksum the checksum of its directory at the time.
+	Deployed time.Time `json:"deployed"`
+	Checksum string    `json:"checksum,omitempty"`
+
+	// LastError is the reason the version most recently failed, which is
+	// kept once it has recovered.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// stateStore keeps a deployment's local state in a file, replacing the file
+// atomically each time the state changes. The file is private to the agent's
+// user, whatever the deployment's owner and permissions. It is safe for
+// concurrent use.
+type stateStore struct {
+	path string
+
+	// restored reports whether the state was read from an existing file.
+	restored bool
+
+	state localState
+	lock  sync.Mutex
+}
+
+// openStore reads the local state stored at path, which is empty if the
+// file does not exist. The store is returned even if the file cannot be
+// read, in which case it starts out empty and replaces the file when it is
+// next changed.
+func openStore(path string) (*stateStore, error) {
+	s := &stateStore{
+		path:  path,
+		state: localState{Versions: map[string]*localVersion{}},
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+
+	var state localState
+	if err := json.Unmarshal(contents, &state); err != nil {
+		return s, err
+	}
+
+	if state.Versions == nil {
+		state.Versions = map[string]*localVersion{}
+	}
+
+	s.state = state
+	s.restored = true
+	return s, nil
+}
+
+// current returns the version most recently rolled out on the local node,
+// and whether one has been recorded.
+func (s *stateStore) current() (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.state.Current, s.state.Current != ""
+}
+
+// version returns the recorded state of a version.
+func (s *stateStore) version(id string) (localVersion, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	version, exists := s.state.Versions[id]
+	if !exists {
+		return localVersion{}, false
+	}
+
+	return *version, true
+}
+
+// setCurrent records the version most recently rolled out on the local node.
+func (s *stateStore) setCurrent(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.state.Current = id
+	return s.save()
+}
+
+// setRecord records the most recent record published for a version.
+func (s *stateStore) setRecord(id string, record states.Record) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	version, exists := s.state.Versions[id]
+	if !exists {
+		version = &localVersion{}
+		s.state.Versions[id] = version
+	}
+
+	version.Record = record
+
+	switch {
+	case record.State == states.Deploying:
+		version.Deployed = time.Time{}
+		version.Checksum = ""
+	case record.State == states.Available && record.Phase == string(deployTask):
+		version.Deployed = record.Timestamp
+		version.Checksum = record.Checksum
+	case record.State == states.Failed:
+		version.LastError = record.Reason()
+	}
+
+	return s.save()
+}
+
+// remove forgets a version once it has been removed from the local node.
+func (s *stateStore) remove(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.state.Versions[id]; !exists {
+		return nil
+	}
+
+	delete(s.state.Versions, id)
+	return s.save()
+}
+
+// save writes the state to the store's file, it must be called with the
+// lock held.
+func (s *stateStore) save() error {
+	contents, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), defaultDirMode); err != nil {
+		return err
+	}
+
+	return writePrivateFile(s.path, contents)
+}
@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/EMSSConsulting/Depro/states"
+)
+
+func TestStateStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "depro")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	path := filepath.Join(root, "api", storeFile)
+
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if store.restored {
+		t.Fatal("expected a missing store not to be restored")
+	}
+
+	deployed := time.Now().UTC().Truncate(time.Second)
+	code := 2
+
+	records := []struct {
+		id     string
+		record states.Record
+	}{
+		{"v1", states.Record{State: states.Deploying, Timestamp: deployed}},
+		{"v1", states.Record{State: states.Available, Timestamp: deployed, Phase: "deploy", Checksum: "sha256:abc"}},
+		{"v1", states.Record{State: states.Active, Timestamp: deployed.Add(time.Minute), Phase: "rollout"}},
+		{"v2", states.Record{State: states.Failed, Timestamp: deployed, Phase: "deploy", ExitCode: &code, Error: "exit status 2"}},
+		{"v3", states.Record{State: states.Available, Timestamp: deployed, Phase: "deploy"}},
+	}
+
+	for _, r := range records {
+		if err := store.setRecord(r.id, r.record); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	if err := store.setCurrent("v1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := store.remove("v3"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if runtime.GOOS != "windows" {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+			t.Fatalf("bad file mode, got '%v' (%v), expected '%o'", info.Mode().Perm(), err, 0600)
+		}
+	}
+
+	store, err = openStore(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !store.restored {
+		t.Fatal("expected the store to be restored")
+	}
+
+	if current, _ := store.current(); current != "v1" {
+		t.Fatalf("bad current version, got '%s', expected '%s'", current, "v1")
+	}
+
+	v1, _ := store.version("v1")
+	if v1.Record.State != states.Active || !v1.Deployed.Equal(deployed) || v1.Checksum != "sha256:abc" {
+		t.Fatalf("bad version, got %#v", v1)
+	}
+
+	v2, _ := store.version("v2")
+	if v2.Record.State != states.Failed || v2.LastError != "deploy exited with code 2: exit status 2" {
+		t.Fatalf("bad version, got %#v", v2)
+	}
+
+	if _, recorded := store.version("v3"); recorded {
+		t.Fatal("expected removed version to be forgotten")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	store, err = openStore(path)
+	if err == nil {
+		t.Fatal("expected a corrupt store to be reported")
+	}
+
+	if store == nil || store.restored {
+		t.Fatal("expected a corrupt store to start out empty")
+	}
+}
+
+func TestDeployment_LocalState(t *testing.T) {
+	root, err := ioutil.TempDir("", "depro")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	d := &Deployment{Config: &DeploymentConfig{ID: "api", Path: root}}
+	d.live = d.Config
+
+	for _, id := range []string{"v1", "v2", "v3", "v4"} {
+		os.Mkdir(filepath.Join(root, id), os.ModePerm)
+	}
+
+	// Without any local state, every directory is assumed to be deployed
+	d.store, _ = openStore(filepath.Join(root, storeFile))
+	if state := d.localState("v4"); state != states.Available {
+		t.Fatalf("bad state, got '%s', expected '%s'", state, states.Available)
+	}
+
+	d.store.setRecord("v1", states.Record{State: states.Active})
+	d.store.setRecord("v2", states.Record{State: states.Failed})
+	d.store.setRecord("v3", states.Record{State: states.Deploying})
+	d.store.setRecord("v5", states.Record{State: states.Available})
+
+	d.store, _ = openStore(filepath.Join(root, storeFile))
+
+	expected := map[string]states.State{
+		"v1": states.Available,
+		"v2": states.Failed,
+		"v3": states.Unregistered,
+		"v4": states.Unregistered,
+		"v5": states.Unregistered,
+	}
+
+	for id, state := range expected {
+		if actual := d.localState(id); actual != state {
+			t.Fatalf("bad state for '%s', got '%s', expected '%s'", id, actual, state)
+		}
+	}
+}
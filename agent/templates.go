@@ -0,0 +1,223 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/EMSSConsulting/Depro/common"
+)
+
+// resolveTemplates applies the configuration's templates to each of the given
+// deployments and substitutes the deployments' variables into their values,
+// reporting any deployments whose templates could not be resolved.
+func (c *Config) resolveTemplates(deployments []DeploymentConfig) common.Problems {
+	problems := common.Problems{}
+
+	for i := range deployments {
+		deployment := &deployments[i]
+
+		if deployment.Extends != "" {
+			template, err := c.template(deployment.Extends, nil)
+			if err != nil {
+				problems = append(problems, common.Problem{
+					File:    deployment.source,
+					Field:   deployment.field(i, "extends"),
+					Message: err.Error(),
+				})
+				continue
+			}
+
+			deployment.inherit(&template)
+		}
+
+		deployment.substitute()
+	}
+
+	return problems
+}
+
+// template returns the named template with the templates it extends, in turn,
+// applied to it. The names of the templates already visited are used to
+// detect templates which extend themselves.
+func (c *Config) template(name string, visited []string) (DeploymentConfig, error) {
+	for _, seen := range visited {
+		if seen == name {
+			return DeploymentConfig{}, fmt.Errorf("template '%s' extends itself through %s", name, strings.Join(append(visited, name), " -> "))
+		}
+	}
+
+	template, exists := c.Templates[name]
+	if !exists {
+		return DeploymentConfig{}, fmt.Errorf("unknown template '%s'%s", name, c.knownTemplates())
+	}
+
+	if template.Extends != "" {
+		parent, err := c.template(template.Extends, append(visited, name))
+		if err != nil {
+			return DeploymentConfig{}, err
+		}
+
+		template.inherit(&parent)
+	}
+
+	return template, nil
+}
+
+func (c *Config) knownTemplates() string {
+	if len(c.Templates) == 0 {
+		return ", no templates are defined"
+	}
+
+	names := make([]string, 0, len(c.Templates))
+	for name := range c.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return fmt.Sprintf(", expected one of %s", strings.Join(names, ", "))
+}
+
+// recordSetFields records which values of the configuration's deployments
+// and templates were set in the JSON document they were decoded from.
+func (c *Config) recordSetFields(doc []byte) {
+	var raw struct {
+		Deployments []map[string]interface{}          `json:"deployments"`
+		Templates   map[string]map[string]interface{} `json:"templates"`
+	}
+
+	if err := json.Unmarshal(doc, &raw); err != nil {
+		return
+	}
+
+	for i := range c.Deployments {
+		if i < len(raw.Deployments) {
+			fields, _ := common.FieldNames(raw.Deployments[i], &c.Deployments[i])
+			c.Deployments[i].setFields(fields)
+		}
+	}
+
+	for name, template := range c.Templates {
+		fields, _ := common.FieldNames(raw.Templates[name], &template)
+		template.setFields(fields)
+		c.Templates[name] = template
+	}
+}
+
+// setFields records the names of the values set in the deployment's source.
+func (d *DeploymentConfig) setFields(fields []string) {
+	d.set = map[string]struct{}{}
+	for _, field := range fields {
+		d.set[field] = struct{}{}
+	}
+}
+
+// isSet reports whether the deployment set the value of a field. Values of
+// deployments which were not decoded are set when they are not zero.
+func (d *DeploymentConfig) isSet(field reflect.StructField, value reflect.Value) bool {
+	if d.set == nil {
+		return !isZero(value)
+	}
+
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" {
+		name = field.Name
+	}
+
+	_, set := d.set[name]
+	return set
+}
+
+// inherit sets each of the deployment's values which it did not set itself
+// to the template's value, so that a deployment may replace a template's
+// value with an empty one, or remove a template's script with an empty list.
+func (d *DeploymentConfig) inherit(template *DeploymentConfig) {
+	dv := reflect.ValueOf(d).Elem()
+	tv := reflect.ValueOf(template).Elem()
+
+	for i := 0; i < dv.NumField(); i++ {
+		field := dv.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if !d.isSet(field, dv.Field(i)) {
+			dv.Field(i).Set(tv.Field(i))
+		}
+	}
+}
+
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// substitute replaces the ${id}, ${path} and ${prefix} variables in the
+// deployment's values with its own. The path and prefix may only make use of
+// the deployment's id, while every other value may use all three.
+func (d *DeploymentConfig) substitute() {
+	d.Path = strings.Replace(d.Path, "${id}", d.ID, -1)
+	d.Prefix = strings.Replace(d.Prefix, "${id}", d.ID, -1)
+
+	replacer := strings.NewReplacer(
+		"${id}", d.ID,
+		"${path}", d.Path,
+		"${prefix}", d.Prefix,
+	)
+
+	v := reflect.ValueOf(d).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		switch v.Type().Field(i).Name {
+		case "ID", "Path", "Prefix", "Extends":
+			continue
+		}
+
+		if v.Type().Field(i).PkgPath != "" {
+			continue
+		}
+
+		substitute(v.Field(i), replacer)
+	}
+}
+
+func substitute(v reflect.Value, replacer *strings.Replacer) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(replacer.Replace(v.String()))
+	case reflect.Slice:
+		if v.IsNil() {
+			return
+		}
+
+		// Lists may be shared with the template they were inherited from.
+		items := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(items, v)
+		for i := 0; i < items.Len(); i++ {
+			substitute(items.Index(i), replacer)
+		}
+
+		v.Set(items)
+	case reflect.Ptr:
+		if v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			return
+		}
+
+		// As with lists, the value may be shared with a template.
+		item := reflect.New(v.Elem().Type())
+		item.Elem().Set(v.Elem())
+		substitute(item.Elem(), replacer)
+		v.Set(item)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				substitute(v.Field(i), replacer)
+			}
+		}
+	}
+}
@@ -1,12 +1,18 @@
 package agent
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/EMSSConsulting/Depro/states"
 	"github.com/EMSSConsulting/Depro/util"
+	"github.com/EMSSConsulting/Depro/version"
 	"github.com/EMSSConsulting/Executor"
 	"github.com/EMSSConsulting/waiter"
 	"github.com/hashicorp/consul/api"
@@ -16,13 +22,32 @@ type Version struct {
 	ID string
 
 	deployment *Deployment
-	state      chan string
-	lastState  string
-	close      chan struct{}
 	client     *api.Client
 	customer   *waiter.Customer
-	registered bool
 	log        *log.Logger
+
+	// state is fed to the customer by publish, which always sends the most
+	// recent record set with setState or setRecord.
+	state      chan string
+	lastRecord states.Record
+	stateLock  sync.Mutex
+	updated    chan struct{}
+
+	// store records each new record on the local node, while restored is
+	// the record which was recorded before the agent started.
+	store    *stateStore
+	restored *states.Record
+
+	// attempts counts the times each phase has been started.
+	attempts map[taskKind]int
+
+	// stop is closed by shutdown, while done is closed once the customer has
+	// stopped receiving state updates and released once register has
+	// removed the version's entry.
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	released chan struct{}
 }
 
 func newVersion(deployment *Deployment, id string) *Version {
@@ -31,170 +56,366 @@ func newVersion(deployment *Deployment, id string) *Version {
 		deployment: deployment,
 		client:     deployment.client,
 		state:      make(chan string),
-		lastState:  "unregistered",
-		close:      make(chan struct{}),
+		lastRecord: states.Record{State: states.Unregistered},
+		updated:    make(chan struct{}, 1),
+		attempts:   map[taskKind]int{},
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		released:   make(chan struct{}),
 		log:        log.New(os.Stdout, fmt.Sprintf("[%s@%s]", deployment.Config.ID, id), log.Ltime),
 	}
 
+	if deployment.validVersion(id) {
+		v.store = deployment.store
+
+		if local, recorded := v.store.version(id); recorded {
+			v.restored = &local.Record
+		}
+	}
+
 	v.customer = waiter.NewCustomer(v.client, deployment.versionPrefix(id), deployment.agentConfig.Name, v.state)
 
 	return v
 }
 
-func (v *Version) deploy() (string, error) {
-	v.setState("deploying", true)
-	output := fmt.Sprintf("Preparing directory '%s'\n", v.fullPath())
+func (v *Version) deploy(run *scriptContext) ([]scriptOutput, error) {
+	started := time.Now()
+	v.setRecord(states.Record{State: states.Deploying, Phase: string(deployTask)})
+	v.log.Printf("preparing directory '%s'\n", v.fullPath())
+
+	config := v.deployment.settings()
 
 	err := v.recreateDirectory()
 	if err != nil {
-		v.setState("failed", false)
-		return "", err
+		run.Step = string(deployTask)
+		return v.fail(config, run, started, err, nil), err
 	}
 
-	if len(v.deployment.Config.Deploy) > 0 {
-		ex := v.getExecutor()
+	outputs, err := v.runSteps(config, config.steps(deployTask), run)
+	if err != nil {
+		return v.fail(config, run, started, err, outputs), err
+	}
 
-		task, err := executor.NewTask(v.deployment.Config.Deploy, nil, nil)
-		if err != nil {
-			v.setState("failed", false)
-			return output, err
-		}
+	v.finish(string(deployTask), started, states.Available, nil)
+	return outputs, nil
+}
 
-		cmdOutput, err := ex.RunOutput(task)
-		output = output + string(cmdOutput)
-		if err != nil {
-			v.setState("failed", false)
-			return output, err
-		}
+func (v *Version) rollout(run *scriptContext) ([]scriptOutput, error) {
+	started := time.Now()
+	v.setRecord(states.Record{State: states.Starting, Phase: string(rolloutTask)})
+	config := v.deployment.settings()
+
+	outputs, err := v.runSteps(config, config.steps(rolloutTask), run)
+	if err != nil {
+		return v.fail(config, run, started, err, outputs), err
 	}
 
-	v.setState("available", false)
-	return output, nil
+	v.finish(string(rolloutTask), started, states.Active, nil)
+	return outputs, nil
 }
 
-func (v *Version) rollout() (string, error) {
-	output := ""
+func (v *Version) clean(run *scriptContext) ([]scriptOutput, error) {
+	started := time.Now()
+	config := v.deployment.settings()
 
-	v.setState("starting", true)
-	ex := v.getExecutor()
+	// Whether or not it succeeds, the version is deployed again from scratch
+	// if it is added back.
+	defer v.forget()
 
-	task, err := executor.NewTask(v.deployment.Config.Rollout, nil, nil)
+	outputs, err := v.runSteps(config, config.steps(cleanTask), run)
 	if err != nil {
-		v.setState("failed", false)
-		return output, err
+		return v.fail(config, run, started, err, outputs), err
 	}
 
-	cmdOutput, err := ex.RunOutput(task)
-	output = output + string(cmdOutput)
+	err = v.removeDirectory()
 	if err != nil {
-		v.setState("failed", false)
-		return output, err
+		return outputs, err
 	}
 
-	v.setState("active", false)
-	return output, nil
+	return outputs, nil
 }
 
-func (v *Version) clean() (string, error) {
-	output := ""
+// register publishes an entry in the correct version node on the server
+// to inform watchers of the state of the local copy of this version.
+// It blocks until the version is shut down, at which point the entry is
+// removed from the server. Failed registrations are retried until the
+// version is shut down.
+func (v *Version) register() error {
+	v.log.Printf("registering\n")
+	defer close(v.released)
+
+	go v.publish()
+
+	backoff := util.Backoff{Min: retryMinDelay, Max: retryMaxDelay}
+	for {
+		err := v.customer.Run(v.deployment.session)
+		if err == nil {
+			break
+		}
 
-	if len(v.deployment.Config.Clean) > 0 {
-		ex := v.getExecutor()
+		delay := backoff.Next()
+		v.log.Printf("registration failed, retrying in %s: %s", delay, err)
 
-		task, err := executor.NewTask(v.deployment.Config.Clean, nil, nil)
-		if err != nil {
-			v.setState("failed", false)
-			return output, err
+		select {
+		case <-time.After(delay):
+		case <-v.stop:
+		}
+
+		if v.stopped() {
+			break
 		}
 
-		cmdOutput, err := ex.RunOutput(task)
-		output = output + string(cmdOutput)
+		// The new customer is sent the latest state once it starts, as the
+		// failed customer may not have published it.
+		v.customer = waiter.NewCustomer(v.client, v.deployment.versionPrefix(v.ID), v.deployment.agentConfig.Name, v.state)
+		v.signalUpdate()
 	}
 
-	err := v.removeDirectory()
+	close(v.done)
+
+	_, err := v.client.KV().Delete(fmt.Sprintf("%s/%s", v.deployment.versionPrefix(v.ID), v.deployment.agentConfig.Name), nil)
 	if err != nil {
-		return output, err
+		v.log.Printf("could not remove registration: %s", err)
+		return err
 	}
 
-	v.shutdown()
-
-	return output, nil
+	v.log.Printf("deregistered")
+	return nil
 }
 
-// register publishes an entry in the correct version node on the server
-// to inform watchers of the state of the local copy of this version.
-func (v *Version) register() error {
-	v.log.Printf("registering\n")
-	v.registered = true
-	defer func() { v.registered = false }()
+// attempt counts the times a phase has been started for the version,
+// returning the number of the attempt which is starting.
+func (v *Version) attempt(phase taskKind) int {
+	v.stateLock.Lock()
+	defer v.stateLock.Unlock()
 
-	doneCh := make(chan struct{})
+	v.attempts[phase]++
+	return v.attempts[phase]
+}
 
-	// Function to shutdown this version's goroutines when the application
-	// requests an exit.
-	go func() {
-		shutdownCh := util.MakeShutdownCh()
+// stopped reports whether the version has been shut down.
+func (v *Version) stopped() bool {
+	select {
+	case <-v.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// publish forwards state changes to the customer until the version is shut
+// down, at which point the customer is stopped.
+func (v *Version) publish() {
+	defer close(v.state)
 
+	for {
 		select {
-		case <-shutdownCh:
-			v.shutdown()
-		case <-doneCh:
-			v.shutdown()
+		case <-v.stop:
+			return
+		case <-v.done:
+			return
+		case <-v.updated:
+			v.stateLock.Lock()
+			record := v.lastRecord
+			v.stateLock.Unlock()
+
+			select {
+			case v.state <- record.Encode():
+			case <-v.stop:
+				return
+			case <-v.done:
+				return
+			}
 		}
-	}()
+	}
+}
 
-	err := v.customer.Run(v.deployment.session)
+// shutdown stops the version's registration, it is safe to call multiple
+// times and from any goroutine.
+func (v *Version) shutdown() {
+	v.stopOnce.Do(func() {
+		v.log.Printf("shutting down\n")
+		close(v.stop)
+	})
+}
+
+// signalUpdate causes the most recent state to be published.
+func (v *Version) signalUpdate() {
+	select {
+	case v.updated <- struct{}{}:
+	default:
+	}
+}
+
+// setState sets the state of this version entry without blocking. If the
+// version is already in the state, its record is published again unchanged,
+// as is the record from before the agent started if it is the first state
+// set and is the same settled state.
+func (v *Version) setState(state states.State) error {
+	v.stateLock.Lock()
+	current := v.lastRecord.State
+	restored := current == states.Unregistered && v.restored != nil && v.restored.State == state && state.Settled()
+	if restored {
+		v.lastRecord = *v.restored
+	}
+	v.stateLock.Unlock()
+
+	if restored {
+		v.log.Printf("{%s} restored\n", state)
+	}
+
+	if state == current || restored {
+		v.signalUpdate()
+		return nil
+	}
+
+	return v.setRecord(states.Record{State: state})
+}
+
+// setRecord sets the record published for this version entry without
+// blocking. If the record changes again before it has been published, only
+// the most recent record is published. Illegal transitions are rejected,
+// leaving the current record in place.
+func (v *Version) setRecord(record states.Record) error {
+	record.Timestamp = time.Now().UTC()
+	record.AgentVersion = version.Version
+
+	v.stateLock.Lock()
+	err := states.Transition(v.lastRecord.State, record.State)
+	if err == nil {
+		v.lastRecord = record
+		v.record(record)
+	}
+	v.stateLock.Unlock()
 
 	if err != nil {
-		v.log.Printf("registration failed: %s", err)
+		v.log.Printf("could not set state {%s}: %s\n", record.State, err)
+		return err
+	}
+
+	if reason := record.Reason(); reason != "" {
+		v.log.Printf("{%s} %s\n", record.State, reason)
 	} else {
-		v.log.Printf("deregistered")
+		v.log.Printf("{%s}\n", record.State)
 	}
 
-	close(doneCh)
-	return err
+	v.signalUpdate()
+	return nil
 }
 
-func (v *Version) shutdown() {
-	if v.state == nil {
+// finish records the outcome of a phase which began at the given time,
+// publishing the failed state along with the reason if the phase returned an
+// error.
+func (v *Version) finish(phase string, started time.Time, state states.State, err error) error {
+	return v.finishStep(phase, "", started, state, err)
+}
+
+// finishStep publishes the state reached by a phase, along with the step
+// within it which failed.
+func (v *Version) finishStep(phase, step string, started time.Time, state states.State, err error) error {
+	record := states.Record{
+		State:    state,
+		Phase:    phase,
+		Step:     step,
+		Duration: time.Since(started),
+	}
+
+	if err != nil {
+		record.State = states.Failed
+		record.Error = err.Error()
+		record.ExitCode = exitCode(err)
+	}
+
+	if phase == string(deployTask) && record.State == states.Available {
+		checksum, err := checksumDirectory(v.fullPath())
+		if err != nil {
+			v.log.Printf("could not checksum version: %s\n", err)
+		}
+
+		record.Checksum = checksum
+	}
+
+	return v.setRecord(record)
+}
+
+// record keeps a new record in the local state, it must be called with the
+// state lock held so that records are kept in the order they were set.
+func (v *Version) record(record states.Record) {
+	if v.store == nil {
+		return
+	}
+
+	if err := v.store.setRecord(v.ID, record); err != nil {
+		v.log.Printf("could not record state {%s}: %s\n", record.State, err)
+	}
+}
+
+// forget removes the version from the local state.
+func (v *Version) forget() {
+	if v.store == nil {
 		return
 	}
 
-	v.log.Printf("shutting down\n")
+	if err := v.store.remove(v.ID); err != nil {
+		v.log.Printf("could not forget local state: %s\n", err)
+	}
+}
 
-	close(v.state)
-	close(v.close)
-	delete(v.deployment.versions, v.ID)
+// exitCode returns the exit code of a script which failed, or nil if the
+// error was not caused by the script exiting.
+func exitCode(err error) *int {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return nil
+	}
 
-	v.state = nil
+	code := exitErr.ExitCode()
+	return &code
 }
 
-// setState sets the state of this version entry in a non-blocking manner.
-// It should only be called once v.register() has been started in a goroutine.
-// Failure to do so will result in your state change being lost.
-func (v *Version) setState(state string, async bool) {
-	v.log.Printf("{%s}\n", state)
+// runScript runs one of the deployment's scripts for the version, with the
+// context in which it is run exported to it.
+func (v *Version) runScript(config *DeploymentConfig, script []string, run *scriptContext) (string, error) {
+	ex := v.getExecutor(config)
+	for name, value := range run.environment() {
+		ex.Environment[name] = value
+	}
 
-	if async {
-		select {
-		case v.state <- state:
-		default:
+	contextFile, err := run.writeFile()
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(contextFile)
+
+	ex.Environment["DEPRO_CONTEXT"] = contextFile
+
+	if config.User != "" {
+		// The script must be able to read its context as its own user
+		if err := chownToUser(contextFile, config.User); err != nil {
+			return "", err
 		}
-	} else {
-		v.state <- state
+
+		output, err := runAs(config.User, config.Shell, ex.Directory, ex.Environment, script)
+		return string(output), err
 	}
 
-	v.lastState = state
+	task, err := executor.NewTask(script, nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := ex.RunOutput(task)
+	return string(output), err
 }
 
-func (v *Version) getExecutor() executor.Executor {
-	executor := executor.NewExecutor(strings.ToLower(v.deployment.Config.Shell))
+func (v *Version) getExecutor(config *DeploymentConfig) executor.Executor {
+	executor := executor.NewExecutor(strings.ToLower(config.Shell))
 
 	executor.Environment["VERSION"] = v.ID
 	executor.Environment["AGENT_NAME"] = v.deployment.agentConfig.Name
-	executor.Environment["DEPLOYMENT_ID"] = v.deployment.Config.ID
-	executor.Environment["DEPLOYMENT_PREFIX"] = v.deployment.Config.Prefix
-	executor.Environment["DEPLOYMENT_PATH"] = v.deployment.Config.Path
+	executor.Environment["DEPLOYMENT_ID"] = config.ID
+	executor.Environment["DEPLOYMENT_PREFIX"] = config.Prefix
+	executor.Environment["DEPLOYMENT_PATH"] = config.Path
 	executor.Directory = v.fullPath()
 
 	return executor
@@ -209,12 +430,20 @@ func (v *Version) fullPath() string {
 }
 
 func (v *Version) recreateDirectory() error {
+	if err := v.deployment.checkVersion(v.ID); err != nil {
+		return err
+	}
+
 	v.removeDirectory()
 
-	return os.MkdirAll(v.fullPath(), os.ModeDir|os.ModePerm)
+	return v.deployment.settings().makeDirectory(v.fullPath())
 }
 
 func (v *Version) removeDirectory() error {
+	if err := v.deployment.checkVersion(v.ID); err != nil {
+		return err
+	}
+
 	if v.exists() {
 		err := os.RemoveAll(v.fullPath())
 		if err != nil {
@@ -226,22 +455,5 @@ func (v *Version) removeDirectory() error {
 }
 
 func (v *Version) exists() bool {
-	f, err := os.Open(v.deployment.fullPath(v.ID))
-
-	if err != nil {
-		return false
-	}
-
-	defer f.Close()
-
-	fInfo, err := f.Stat()
-	if err != nil {
-		return false
-	}
-
-	if !fInfo.IsDir() {
-		return false
-	}
-
-	return true
+	return v.deployment.versionExists(v.ID)
 }
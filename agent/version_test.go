@@ -1,9 +1,110 @@
 package agent
 
 import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/EMSSConsulting/Depro/states"
 )
 
 func TestVersion(t *testing.T) {
 
 }
+
+func testVersion() *Version {
+	return &Version{
+		ID:         "v1",
+		lastRecord: states.Record{State: states.Unregistered},
+		updated:    make(chan struct{}, 1),
+		log:        log.New(ioutil.Discard, "", 0),
+	}
+}
+
+func TestVersion_SetState(t *testing.T) {
+	v := testVersion()
+
+	if err := v.finish(string(deployTask), time.Now(), states.Failed, errors.New("script failed")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	record := states.ParseRecord(v.lastRecord.Encode())
+	if record.State != states.Failed || record.Phase != "deploy" || record.Error != "script failed" || record.Timestamp.IsZero() {
+		t.Fatalf("bad record, got %#v", record)
+	}
+
+	if err := v.setState(states.Available); err == nil {
+		t.Fatalf("bad transition, expected failed versions to reject '%s'", states.Available)
+	}
+
+	// Publishing the same state again keeps the reason for the failure
+	if err := v.setState(states.Failed); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if v.lastRecord.Error != "script failed" {
+		t.Fatalf("bad error, got '%s', expected '%s'", v.lastRecord.Error, "script failed")
+	}
+}
+
+func TestVersion_SetState_Restored(t *testing.T) {
+	failed := time.Now().Add(-time.Hour).UTC()
+
+	v := testVersion()
+	v.restored = &states.Record{State: states.Failed, Timestamp: failed, Phase: "deploy", Error: "script failed"}
+
+	if err := v.setState(states.Failed); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !v.lastRecord.Timestamp.Equal(failed) || v.lastRecord.Error != "script failed" {
+		t.Fatalf("bad record, got %#v, expected the restored record", v.lastRecord)
+	}
+
+	v = testVersion()
+	v.restored = &states.Record{State: states.Available, Timestamp: failed}
+
+	if err := v.setState(states.Deploying); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if v.lastRecord.Timestamp.Equal(failed) {
+		t.Fatalf("bad record, got %#v, expected a new record", v.lastRecord)
+	}
+}
+
+func TestChecksumDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depro")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "bin"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(dir, "bin", "app"), []byte("app"), os.ModePerm)
+
+	first, err := checksumDirectory(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !strings.HasPrefix(first, "sha256:") {
+		t.Fatalf("bad checksum, got '%s', expected a sha256 checksum", first)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "bin", "app"), []byte("app2"), os.ModePerm)
+
+	second, err := checksumDirectory(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if first == second {
+		t.Fatalf("bad checksum, expected '%s' to change when a file changed", first)
+	}
+}
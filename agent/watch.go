@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/EMSSConsulting/Depro/util"
+)
+
+var (
+	// watchMinInterval is the shortest time between the queries made by a
+	// watch, preventing hot loops when Consul returns without the index
+	// advancing.
+	watchMinInterval = 1 * time.Second
+
+	// retryMinDelay and retryMaxDelay bound the delays between retries of
+	// failed requests to Consul.
+	retryMinDelay = 1 * time.Second
+	retryMaxDelay = 1 * time.Minute
+)
+
+// blockingQuery performs a blocking query which waits for the index to pass
+// waitIndex, returning the index of its result.
+type blockingQuery func(ctx context.Context, waitIndex uint64) (uint64, error)
+
+// watchStatus is informed whenever a watch starts or stops failing.
+type watchStatus interface {
+	markDegraded(name, message string)
+	markHealthy(name string)
+}
+
+// watch repeatedly performs a blocking query until the context is cancelled.
+// Failed queries are retried with a jittered, exponential backoff during
+// which the watch is reported as degraded.
+func watch(ctx context.Context, name string, status watchStatus, query blockingQuery) {
+	backoff := util.Backoff{Min: retryMinDelay, Max: retryMaxDelay}
+	waitIndex := uint64(0)
+	lastQuery := time.Time{}
+
+	for {
+		if !util.Sleep(ctx, watchMinInterval-time.Since(lastQuery)) {
+			return
+		}
+
+		lastQuery = time.Now()
+		index, err := query(ctx, waitIndex)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			delay := backoff.Next()
+			status.markDegraded(name, fmt.Sprintf("unable to watch %s, retrying in %s: %s", name, delay, err))
+
+			if !util.Sleep(ctx, delay) {
+				return
+			}
+
+			continue
+		}
+
+		backoff.Reset()
+		status.markHealthy(name)
+
+		// Consul's index may go backwards, for example when a snapshot is
+		// restored, in which case the watch must start again from scratch.
+		if index < waitIndex {
+			index = 0
+		}
+
+		waitIndex = index
+	}
+}
+
+// markDegraded records that part of the deployment is unable to reach Consul.
+func (d *Deployment) markDegraded(name, message string) {
+	d.degradedLock.Lock()
+	defer d.degradedLock.Unlock()
+
+	if len(d.degraded) == 0 {
+		d.ui.Warn(fmt.Sprintf("[%s] degraded", d.Config.ID))
+	}
+
+	d.degraded[name] = struct{}{}
+	d.ui.Warn(fmt.Sprintf("[%s] %s", d.Config.ID, message))
+}
+
+// markHealthy records that part of the deployment is able to reach Consul
+// again.
+func (d *Deployment) markHealthy(name string) {
+	d.degradedLock.Lock()
+	defer d.degradedLock.Unlock()
+
+	if _, degraded := d.degraded[name]; !degraded {
+		return
+	}
+
+	delete(d.degraded, name)
+	d.ui.Info(fmt.Sprintf("[%s] %s recovered", d.Config.ID, name))
+
+	if len(d.degraded) == 0 {
+		d.ui.Info(fmt.Sprintf("[%s] no longer degraded", d.Config.ID))
+	}
+}
+
+// Degraded reports whether any part of the deployment is currently unable
+// to reach Consul.
+func (d *Deployment) Degraded() bool {
+	d.degradedLock.Lock()
+	defer d.degradedLock.Unlock()
+
+	return len(d.degraded) > 0
+}
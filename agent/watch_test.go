@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/cli"
+)
+
+func TestDeployment_Watch(t *testing.T) {
+	defer func(interval, min, max time.Duration) {
+		watchMinInterval, retryMinDelay, retryMaxDelay = interval, min, max
+	}(watchMinInterval, retryMinDelay, retryMaxDelay)
+
+	watchMinInterval = time.Millisecond
+	retryMinDelay = time.Millisecond
+	retryMaxDelay = 2 * time.Millisecond
+
+	var output bytes.Buffer
+	d := &Deployment{
+		Config:   &DeploymentConfig{ID: "test"},
+		ui:       &cli.BasicUi{Writer: &output},
+		degraded: map[string]struct{}{},
+	}
+
+	type result struct {
+		index uint64
+		err   error
+	}
+
+	results := []result{
+		{index: 10},
+		{err: errors.New("connection refused")},
+		{err: errors.New("connection refused")},
+		{index: 12},
+		{index: 5},
+		{index: 6},
+	}
+
+	// Failed queries are retried with the same index, while an index which
+	// goes backwards restarts the watch from zero.
+	expected := []uint64{0, 10, 10, 10, 12, 0}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	waitIndexes := []uint64{}
+	degraded := false
+
+	watch(ctx, "versions", d, func(ctx context.Context, waitIndex uint64) (uint64, error) {
+		waitIndexes = append(waitIndexes, waitIndex)
+		if len(waitIndexes) == 3 {
+			degraded = d.Degraded()
+		}
+
+		r := results[len(waitIndexes)-1]
+		if len(waitIndexes) == len(results) {
+			cancel()
+		}
+
+		return r.index, r.err
+	})
+
+	for i, index := range expected {
+		if waitIndexes[i] != index {
+			t.Fatalf("bad wait index for query %d, got %d, expected %d", i, waitIndexes[i], index)
+		}
+	}
+
+	if !degraded {
+		t.Fatalf("expected the deployment to be degraded while queries were failing")
+	}
+
+	if d.Degraded() {
+		t.Fatalf("expected the deployment to recover once queries succeeded")
+	}
+
+	if !strings.Contains(output.String(), "[test] versions recovered") {
+		t.Fatalf("bad output, got '%s'", output.String())
+	}
+}
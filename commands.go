@@ -2,7 +2,9 @@ package main
 
 import (
 	_ "github.com/EMSSConsulting/Depro/agent"
+	_ "github.com/EMSSConsulting/Depro/config"
 	_ "github.com/EMSSConsulting/Depro/deploy"
 	_ "github.com/EMSSConsulting/Depro/query"
 	_ "github.com/EMSSConsulting/Depro/version"
+	_ "github.com/EMSSConsulting/Depro/versions"
 )
@@ -2,7 +2,11 @@ package common
 
 import (
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,6 +26,115 @@ type Config struct {
 	WaitTime    time.Duration `json:"-"`
 	WaitTimeRaw string        `json:"wait"`
 	AllowStale  bool          `json:"allowStale"`
+
+	// Consistency is the consistency mode used for reads from Consul, while
+	// stale reads whose results are older than MaxStale are retried in
+	// consistent mode.
+	Consistency string        `json:"consistency"`
+	MaxStale    time.Duration `json:"-"`
+	MaxStaleRaw string        `json:"maxStale"`
+
+	// TokenFile and CredentialsFile are files containing the token, and the
+	// username:password used for basic auth, respectively. They take the
+	// place of Token and Username/Password, and are read again whenever
+	// they change.
+	TokenFile       string `json:"tokenFile"`
+	CredentialsFile string `json:"credentialsFile"`
+
+	// Scheme is the URI scheme used to connect to Consul, either http or
+	// https, while the remaining values configure its TLS connections.
+	Scheme             string `json:"scheme"`
+	CAFile             string `json:"caFile"`
+	CAPath             string `json:"caPath"`
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	TLSServerName      string `json:"tlsServerName"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+
+	// Sources records where each of the configuration's values was set.
+	Sources Sources `json:"-"`
+}
+
+// Sources records where configuration values were set, keyed by the JSON
+// name of each value. Values which are not present were left at their
+// defaults.
+type Sources map[string]string
+
+const (
+	// SourceDefault is reported for values which were not set explicitly.
+	SourceDefault = "default"
+	// SourceEnvironment is reported for values set by environment variables.
+	SourceEnvironment = "env"
+	// SourceFlag is reported for values set by command line flags.
+	SourceFlag = "flag"
+	// SourceFile is recorded for values decoded from a configuration file
+	// until the file's path is known.
+	SourceFile = "file"
+)
+
+// Source returns where the value with the given name was set.
+func (c *Config) Source(key string) string {
+	if source, exists := c.Sources[key]; exists {
+		return source
+	}
+
+	return SourceDefault
+}
+
+// FileOf returns the path of the configuration file which set the value with
+// the given name, or an empty string if it was not set by a file.
+func (c *Config) FileOf(key string) string {
+	switch source := c.Source(key); source {
+	case SourceDefault, SourceEnvironment, SourceFlag, SourceFile:
+		return ""
+	default:
+		return source
+	}
+}
+
+// SetSource records where the value with the given name was set.
+func (c *Config) SetSource(key, source string) {
+	if c.Sources == nil {
+		c.Sources = Sources{}
+	}
+
+	c.Sources[key] = source
+}
+
+// IsSet reports whether the value with the given name was explicitly set,
+// even if it was set to its zero value.
+func (c *Config) IsSet(key string) bool {
+	_, exists := c.Sources[key]
+	return exists
+}
+
+// MergeSource copies the source of a value from b, which must be called
+// whenever a value is merged from b.
+func (c *Config) MergeSource(b *Config, key string) {
+	if source, exists := b.Sources[key]; exists {
+		c.SetSource(key, source)
+	} else if c.Sources != nil {
+		delete(c.Sources, key)
+	}
+}
+
+// SetFileSource records the path of the file from which the values decoded
+// from a configuration file were read.
+func (c *Config) SetFileSource(path string) {
+	for key, source := range c.Sources {
+		if source == SourceFile {
+			c.Sources[key] = path
+		}
+	}
+}
+
+// Equal reports whether both configurations have the same values, regardless
+// of where they were set.
+func (c *Config) Equal(other *Config) bool {
+	a, b := *c, *other
+	a.Sources, b.Sources = nil, nil
+
+	return reflect.DeepEqual(a, b)
 }
 
 // DefaultConfig returns a pointer to a populated Config object with sensible
@@ -37,6 +150,10 @@ func DefaultConfig() Config {
 		WaitTime:    1 * time.Second,
 		WaitTimeRaw: "1s",
 		AllowStale:  true,
+		Consistency: ConsistencyDefault,
+		MaxStale:    5 * time.Second,
+		MaxStaleRaw: "5s",
+		Scheme:      "http",
 	}
 
 	LoadEnvironment(&config)
@@ -46,48 +163,149 @@ func DefaultConfig() Config {
 
 // Merge the second command entry into the first and return a reference
 // to the first.
+// Values are merged if they have been explicitly set in the second entry,
+// or if they differ from their zero values.
 func Merge(a, b *Config) {
-	if b.Server != "" {
+	if b.Server != "" || b.IsSet("server") {
 		a.Server = b.Server
+		a.MergeSource(b, "server")
 	}
 
-	if b.Datacenter != "" {
+	if b.Datacenter != "" || b.IsSet("datacenter") {
 		a.Datacenter = b.Datacenter
+		a.MergeSource(b, "datacenter")
 	}
 
-	if b.Prefix != "" {
+	if b.Prefix != "" || b.IsSet("prefix") {
 		a.Prefix = b.Prefix
+		a.MergeSource(b, "prefix")
 	}
 
-	if b.WaitTime != 0 {
+	if b.WaitTime != 0 || b.IsSet("wait") {
 		a.WaitTime = b.WaitTime
 		a.WaitTimeRaw = b.WaitTimeRaw
+		a.MergeSource(b, "wait")
 	}
 
-	if b.Username != "" {
+	if b.Username != "" || b.IsSet("username") {
 		a.Username = b.Username
+		a.MergeSource(b, "username")
 	}
 
-	if b.Password != "" {
+	if b.Password != "" || b.IsSet("password") {
 		a.Password = b.Password
+		a.MergeSource(b, "password")
 	}
 
-	if b.Token != "" {
+	if b.Token != "" || b.IsSet("token") {
 		a.Token = b.Token
+		a.MergeSource(b, "token")
 	}
 
-	if b.AllowStale {
+	if b.AllowStale || b.IsSet("allowStale") {
 		a.AllowStale = b.AllowStale
+		a.MergeSource(b, "allowStale")
+	}
+
+	if b.Consistency != "" || b.IsSet("consistency") {
+		a.Consistency = b.Consistency
+		a.MergeSource(b, "consistency")
+	}
+
+	if b.MaxStale != 0 || b.IsSet("maxStale") {
+		a.MaxStale = b.MaxStale
+		a.MaxStaleRaw = b.MaxStaleRaw
+		a.MergeSource(b, "maxStale")
+	}
+
+	if b.TokenFile != "" || b.IsSet("tokenFile") {
+		a.TokenFile = b.TokenFile
+		a.MergeSource(b, "tokenFile")
+	}
+
+	if b.CredentialsFile != "" || b.IsSet("credentialsFile") {
+		a.CredentialsFile = b.CredentialsFile
+		a.MergeSource(b, "credentialsFile")
+	}
+
+	if b.Scheme != "" || b.IsSet("scheme") {
+		a.Scheme = b.Scheme
+		a.MergeSource(b, "scheme")
+	}
+
+	if b.CAFile != "" || b.IsSet("caFile") {
+		a.CAFile = b.CAFile
+		a.MergeSource(b, "caFile")
+	}
+
+	if b.CAPath != "" || b.IsSet("caPath") {
+		a.CAPath = b.CAPath
+		a.MergeSource(b, "caPath")
+	}
+
+	if b.CertFile != "" || b.IsSet("certFile") {
+		a.CertFile = b.CertFile
+		a.MergeSource(b, "certFile")
+	}
+
+	if b.KeyFile != "" || b.IsSet("keyFile") {
+		a.KeyFile = b.KeyFile
+		a.MergeSource(b, "keyFile")
+	}
+
+	if b.TLSServerName != "" || b.IsSet("tlsServerName") {
+		a.TLSServerName = b.TLSServerName
+		a.MergeSource(b, "tlsServerName")
+	}
+
+	if b.InsecureSkipVerify || b.IsSet("insecureSkipVerify") {
+		a.InsecureSkipVerify = b.InsecureSkipVerify
+		a.MergeSource(b, "insecureSkipVerify")
 	}
 }
 
+// commonFlags maps the names of the flags registered by ParseFlags to the
+// values they set.
+var commonFlags = map[string][]string{
+	"server": {"server"},
+	"prefix": {"prefix"},
+	"auth":   {"username", "password"},
+	"token":  {"token"},
+
+	"consistency": {"consistency"},
+	"max-stale":   {"maxStale"},
+
+	"token-file":       {"tokenFile"},
+	"credentials-file": {"credentialsFile"},
+
+	"scheme":               {"scheme"},
+	"ca-file":              {"caFile"},
+	"ca-path":              {"caPath"},
+	"cert-file":            {"certFile"},
+	"key-file":             {"keyFile"},
+	"tls-server-name":      {"tlsServerName"},
+	"insecure-skip-verify": {"insecureSkipVerify"},
+}
+
 func ParseFlags(config *Config, args []string, flags *flag.FlagSet) error {
-	flags.StringVar(&config.Server, "server", "", "Consul HTTP server address")
-	flags.StringVar(&config.Prefix, "prefix", "", "Consul key prefix")
+	flags.StringVar(&config.Server, "server", config.Server, "Consul HTTP server address")
+	flags.StringVar(&config.Prefix, "prefix", config.Prefix, "Consul key prefix")
 
 	var auth string
 	flags.StringVar(&auth, "auth", "", "username:password")
-	flags.StringVar(&config.Token, "token", "", "Cosul API token")
+	flags.StringVar(&config.Token, "token", config.Token, "Cosul API token")
+	flags.StringVar(&config.Consistency, "consistency", config.Consistency, "consistency mode for reads: stale, default or consistent")
+	flags.DurationVar(&config.MaxStale, "max-stale", config.MaxStale, "age after which stale reads are retried consistently")
+	flags.StringVar(&config.TokenFile, "token-file", config.TokenFile, "file containing the Consul API token")
+	flags.StringVar(&config.CredentialsFile, "credentials-file", config.CredentialsFile, "file containing username:password")
+
+	flags.StringVar(&config.Scheme, "scheme", config.Scheme, "Consul HTTP scheme, http or https")
+	flags.StringVar(&config.CAFile, "ca-file", config.CAFile, "CA certificate used to verify Consul's certificate")
+	flags.StringVar(&config.CAPath, "ca-path", config.CAPath, "directory of CA certificates used to verify Consul's certificate")
+	flags.StringVar(&config.CertFile, "cert-file", config.CertFile, "client certificate presented to Consul")
+	flags.StringVar(&config.KeyFile, "key-file", config.KeyFile, "private key of the client certificate")
+	flags.StringVar(&config.TLSServerName, "tls-server-name", config.TLSServerName, "server name used to verify Consul's certificate")
+	flags.BoolVar(&config.InsecureSkipVerify, "insecure-skip-verify", config.InsecureSkipVerify, "don't verify Consul's certificate")
 
 	if err := flags.Parse(args); err != nil {
 		return err
@@ -99,35 +317,123 @@ func ParseFlags(config *Config, args []string, flags *flag.FlagSet) error {
 		config.Password = authComponents[1]
 	}
 
+	MarkFlags(config, flags, commonFlags)
+	if config.Source("maxStale") == SourceFlag {
+		config.MaxStaleRaw = config.MaxStale.String()
+	}
+
 	return nil
 }
 
+// MarkFlags records the values set by any of the given flags which were
+// provided on the command line.
+func MarkFlags(config *Config, flags *flag.FlagSet, keys map[string][]string) {
+	flags.Visit(func(f *flag.Flag) {
+		for _, key := range keys[f.Name] {
+			config.SetSource(key, SourceFlag)
+		}
+	})
+}
+
 func LoadEnvironment(config *Config) {
 	auth := os.Getenv("DEPRO_AUTH")
 	if auth != "" {
 		authComponents := strings.SplitN(auth, ":", 2)
 		config.Username = authComponents[0]
 		config.Password = authComponents[1]
+		config.SetSource("username", SourceEnvironment)
+		config.SetSource("password", SourceEnvironment)
 	}
 
 	token := os.Getenv("DEPRO_TOKEN")
 	if token != "" {
 		config.Token = token
+		config.SetSource("token", SourceEnvironment)
+	}
+
+	consistency := os.Getenv("DEPRO_CONSISTENCY")
+	if consistency != "" {
+		config.Consistency = consistency
+		config.SetSource("consistency", SourceEnvironment)
+	}
+
+	maxStale, err := time.ParseDuration(os.Getenv("DEPRO_MAX_STALE"))
+	if err == nil {
+		config.MaxStale = maxStale
+		config.MaxStaleRaw = maxStale.String()
+		config.SetSource("maxStale", SourceEnvironment)
+	}
+
+	tokenFile := os.Getenv("DEPRO_TOKEN_FILE")
+	if tokenFile != "" {
+		config.TokenFile = tokenFile
+		config.SetSource("tokenFile", SourceEnvironment)
+	}
+
+	credentialsFile := os.Getenv("DEPRO_CREDENTIALS_FILE")
+	if credentialsFile != "" {
+		config.CredentialsFile = credentialsFile
+		config.SetSource("credentialsFile", SourceEnvironment)
 	}
 
 	server := os.Getenv("DEPRO_SERVER")
 	if server != "" {
 		config.Server = server
+		config.SetSource("server", SourceEnvironment)
 	}
 
 	datacenter := os.Getenv("DEPRO_DATACENTER")
 	if datacenter != "" {
 		config.Datacenter = datacenter
+		config.SetSource("datacenter", SourceEnvironment)
 	}
 
 	prefix := os.Getenv("DEPRO_PREFIX")
 	if prefix != "" {
 		config.Prefix = prefix
+		config.SetSource("prefix", SourceEnvironment)
+	}
+
+	scheme := os.Getenv("DEPRO_SCHEME")
+	if scheme != "" {
+		config.Scheme = scheme
+		config.SetSource("scheme", SourceEnvironment)
+	}
+
+	caFile := os.Getenv("DEPRO_CA_FILE")
+	if caFile != "" {
+		config.CAFile = caFile
+		config.SetSource("caFile", SourceEnvironment)
+	}
+
+	caPath := os.Getenv("DEPRO_CA_PATH")
+	if caPath != "" {
+		config.CAPath = caPath
+		config.SetSource("caPath", SourceEnvironment)
+	}
+
+	certFile := os.Getenv("DEPRO_CERT_FILE")
+	if certFile != "" {
+		config.CertFile = certFile
+		config.SetSource("certFile", SourceEnvironment)
+	}
+
+	keyFile := os.Getenv("DEPRO_KEY_FILE")
+	if keyFile != "" {
+		config.KeyFile = keyFile
+		config.SetSource("keyFile", SourceEnvironment)
+	}
+
+	tlsServerName := os.Getenv("DEPRO_TLS_SERVER_NAME")
+	if tlsServerName != "" {
+		config.TLSServerName = tlsServerName
+		config.SetSource("tlsServerName", SourceEnvironment)
+	}
+
+	insecureSkipVerify, err := strconv.ParseBool(os.Getenv("DEPRO_INSECURE_SKIP_VERIFY"))
+	if err == nil {
+		config.InsecureSkipVerify = insecureSkipVerify
+		config.SetSource("insecureSkipVerify", SourceEnvironment)
 	}
 }
 
@@ -137,16 +443,28 @@ func (c *Config) Finalize() error {
 	if c.WaitTimeRaw != "" {
 		waitTime, err := time.ParseDuration(c.WaitTimeRaw)
 		if err != nil {
-			return err
+			return Problems{{Field: "wait", Message: err.Error()}}
 		}
 
 		c.WaitTime = waitTime
 	}
 
+	if c.MaxStaleRaw != "" {
+		maxStale, err := time.ParseDuration(c.MaxStaleRaw)
+		if err != nil {
+			return Problems{{Field: "maxStale", Message: err.Error()}}
+		}
+
+		c.MaxStale = maxStale
+	}
+
 	return nil
 }
 
-func (c *Config) GetAPIClient() *api.Client {
+// GetAPIClient returns a client for the Consul agent described by the
+// configuration, failing if its TLS configuration or credentials files cannot
+// be loaded. Clients read their credentials files again whenever they change.
+func (c *Config) GetAPIClient() (*api.Client, error) {
 	apiConfig := api.DefaultConfig()
 
 	apiConfig.Address = c.Server
@@ -161,6 +479,71 @@ func (c *Config) GetAPIClient() *api.Client {
 		}
 	}
 
-	client, _ := api.NewClient(apiConfig)
-	return client
+	switch c.Scheme {
+	case "":
+	case "http", "https":
+		apiConfig.Scheme = c.Scheme
+	default:
+		return nil, fmt.Errorf("Error configuring Consul client: unsupported scheme '%s', expected http or https", c.Scheme)
+	}
+
+	apiConfig.TLSConfig = api.TLSConfig{
+		Address:            c.TLSServerName,
+		CAFile:             c.CAFile,
+		CAPath:             c.CAPath,
+		CertFile:           c.CertFile,
+		KeyFile:            c.KeyFile,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.TokenFile != "" || c.CredentialsFile != "" {
+		httpClient, err := c.credentialsClient(apiConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Error configuring Consul client: %s", err)
+		}
+
+		apiConfig.HttpClient = httpClient
+	}
+
+	client, err := api.NewClient(apiConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Error configuring Consul client: %s", err)
+	}
+
+	return client, nil
+}
+
+// credentialsClient returns an HTTP client which adds the credentials read
+// from the configuration's credentials files to each request, in place of
+// those in the API configuration.
+func (c *Config) credentialsClient(apiConfig *api.Config) (*http.Client, error) {
+	httpClient, err := api.NewHttpClient(apiConfig.Transport, apiConfig.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &credentialsTransport{
+		base: httpClient.Transport,
+	}
+
+	if c.TokenFile != "" {
+		transport.token, err = newCredentialsFile(c.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+
+		apiConfig.Token = ""
+	}
+
+	if c.CredentialsFile != "" {
+		transport.credentials, err = newCredentialsFile(c.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		apiConfig.HttpAuth = nil
+	}
+
+	httpClient.Transport = transport
+	return httpClient, nil
 }
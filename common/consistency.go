@@ -0,0 +1,102 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// ConsistencyStale allows reads to be served by any server, which may
+	// return results which are out of date.
+	ConsistencyStale = "stale"
+	// ConsistencyDefault serves reads from the leader, which may briefly
+	// return out of date results during leadership changes.
+	ConsistencyDefault = "default"
+	// ConsistencyConsistent serves reads from the leader once it has
+	// confirmed that it is still the leader.
+	ConsistencyConsistent = "consistent"
+)
+
+// consistencyModes are the supported values of Config.Consistency.
+var consistencyModes = []string{ConsistencyStale, ConsistencyDefault, ConsistencyConsistent}
+
+// ConsistencyMode returns the consistency mode used for reads. Configurations
+// which set allowStale, without also choosing a consistency mode, use stale
+// reads.
+func (c *Config) ConsistencyMode() string {
+	mode := strings.ToLower(c.Consistency)
+	if mode == "" {
+		mode = ConsistencyDefault
+	}
+
+	if mode == ConsistencyDefault && !c.IsSet("consistency") && c.IsSet("allowStale") && c.AllowStale {
+		return ConsistencyStale
+	}
+
+	return mode
+}
+
+// QueryOptions returns the options for a read from Consul using the
+// configured consistency mode.
+func (c *Config) QueryOptions() *api.QueryOptions {
+	q := &api.QueryOptions{}
+
+	switch c.ConsistencyMode() {
+	case ConsistencyStale:
+		q.AllowStale = true
+	case ConsistencyConsistent:
+		q.RequireConsistent = true
+	}
+
+	return q
+}
+
+// Read performs a read from Consul with the given options. Stale reads whose
+// results were last in contact with the leader more than MaxStale ago are
+// retried in consistent mode. The retry does not block, since a blocking read
+// has already waited for its results to change.
+func (c *Config) Read(q *api.QueryOptions, read func(q *api.QueryOptions) (*api.QueryMeta, error)) (*api.QueryMeta, error) {
+	meta, err := read(q)
+	if err != nil || !q.AllowStale || c.MaxStale <= 0 || meta.LastContact <= c.MaxStale {
+		return meta, err
+	}
+
+	consistent := *q
+	consistent.AllowStale = false
+	consistent.RequireConsistent = true
+	consistent.WaitIndex = 0
+
+	return read(&consistent)
+}
+
+// Validate checks the values shared by every command, reporting all of the
+// problems found.
+func (c *Config) Validate() Problems {
+	problems := Problems{}
+
+	if !isConsistencyMode(c.Consistency) {
+		problems = append(problems, Problem{
+			File:    c.FileOf("consistency"),
+			Field:   "consistency",
+			Message: fmt.Sprintf("unknown consistency mode '%s', expected one of %s", c.Consistency, strings.Join(consistencyModes, ", ")),
+		})
+	}
+
+	return problems
+}
+
+func isConsistencyMode(mode string) bool {
+	if mode == "" {
+		return true
+	}
+
+	for _, known := range consistencyModes {
+		if strings.ToLower(mode) == known {
+			return true
+		}
+	}
+
+	return false
+}
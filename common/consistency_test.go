@@ -0,0 +1,94 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestConfig_ConsistencyMode(t *testing.T) {
+	cases := []struct {
+		consistency string
+		allowStale  bool
+		sources     Sources
+		expected    string
+	}{
+		{"", false, nil, ConsistencyDefault},
+		{"", true, nil, ConsistencyDefault},
+		{"", true, Sources{"allowStale": "agent.json"}, ConsistencyStale},
+		{"consistent", true, Sources{"allowStale": "agent.json"}, ConsistencyConsistent},
+		{"Consistent", true, Sources{"allowStale": "agent.json", "consistency": "agent.json"}, ConsistencyConsistent},
+		{"stale", false, nil, ConsistencyStale},
+	}
+
+	for i, c := range cases {
+		config := Config{
+			Consistency: c.consistency,
+			AllowStale:  c.allowStale,
+			Sources:     c.sources,
+		}
+
+		if mode := config.ConsistencyMode(); mode != c.expected {
+			t.Fatalf("bad consistency mode for case %d, got '%s', expected '%s'", i, mode, c.expected)
+		}
+	}
+}
+
+func TestConfig_Read(t *testing.T) {
+	config := Config{
+		Consistency: ConsistencyStale,
+		MaxStale:    5 * time.Second,
+	}
+
+	reads := []*api.QueryOptions{}
+	read := func(lastContact time.Duration) func(q *api.QueryOptions) (*api.QueryMeta, error) {
+		return func(q *api.QueryOptions) (*api.QueryMeta, error) {
+			reads = append(reads, q)
+			return &api.QueryMeta{LastContact: lastContact}, nil
+		}
+	}
+
+	q := config.QueryOptions()
+	if !q.AllowStale || q.RequireConsistent {
+		t.Fatalf("bad query options, got allowStale %v and requireConsistent %v", q.AllowStale, q.RequireConsistent)
+	}
+
+	if _, err := config.Read(q, read(time.Second)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(reads) != 1 {
+		t.Fatalf("bad reads, got %d, expected %d", len(reads), 1)
+	}
+
+	reads = reads[:0]
+	q.WaitIndex = 42
+	if _, err := config.Read(q, read(time.Minute)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(reads) != 2 || reads[1].AllowStale || !reads[1].RequireConsistent {
+		t.Fatalf("expected a stale read older than maxStale to be retried consistently")
+	}
+
+	if reads[0].WaitIndex != 42 || reads[1].WaitIndex != 0 {
+		t.Fatalf("bad wait indexes, got %d and %d, expected %d and %d", reads[0].WaitIndex, reads[1].WaitIndex, 42, 0)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	config := DefaultConfig()
+	if problems := config.Validate(); len(problems) != 0 {
+		t.Fatalf("bad problems, got '%s'", problems)
+	}
+
+	config.Consistency = "eventual"
+	config.SetSource("consistency", "agent.json")
+
+	problems := config.Validate()
+	expected := "agent.json: consistency: unknown consistency mode 'eventual', expected one of stale, default, consistent"
+	if len(problems) != 1 || problems[0].String() != expected {
+		t.Fatalf("bad problems, got '%s', expected '%s'", problems, expected)
+	}
+}
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialsFile holds a secret read from a file, which is read again
+// whenever the file is changed so that the secret may be rotated without
+// restarting.
+type credentialsFile struct {
+	path string
+
+	lock    sync.Mutex
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+func newCredentialsFile(path string) (*credentialsFile, error) {
+	f := &credentialsFile{path: path}
+	if _, err := f.read(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// read returns the current contents of the file, re-reading them only if
+// the file has changed since they were last read.
+func (f *credentialsFile) read() (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return "", fmt.Errorf("Error reading '%s': %s", f.path, err)
+	}
+
+	if fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.value, nil
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", fmt.Errorf("Error reading '%s': %s", f.path, err)
+	}
+
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("Error reading '%s': file is empty", f.path)
+	}
+
+	f.modTime = fi.ModTime()
+	f.size = fi.Size()
+	f.value = value
+
+	return f.value, nil
+}
+
+// credentialsTransport adds the current token and basic auth credentials
+// from their files to each request made to Consul.
+type credentialsTransport struct {
+	base http.RoundTripper
+
+	token       *credentialsFile
+	credentials *credentialsFile
+}
+
+func (t *credentialsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests must not be modified by a RoundTripper.
+	req = req.Clone(req.Context())
+
+	if t.token != nil {
+		token, err := t.token.read()
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	if t.credentials != nil {
+		credentials, err := t.credentials.read()
+		if err != nil {
+			return nil, err
+		}
+
+		username, password := splitCredentials(credentials)
+		req.SetBasicAuth(username, password)
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// splitCredentials splits basic auth credentials of the form
+// username:password into their parts.
+func splitCredentials(credentials string) (string, string) {
+	components := strings.SplitN(credentials, ":", 2)
+	if len(components) < 2 {
+		return components[0], ""
+	}
+
+	return components[0], components[1]
+}
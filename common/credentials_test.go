@@ -0,0 +1,109 @@
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfig_GetAPIClient_TokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depro-common")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokens := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens <- r.Header.Get("X-Consul-Token")
+		w.Write([]byte("null"))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("first\n"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config := DefaultConfig()
+	config.Server = server.Listener.Addr().String()
+	config.Token = "ignored"
+	config.TokenFile = tokenFile
+
+	client, err := config.GetAPIClient()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, _, err := client.KV().Get("key", nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if token := <-tokens; token != "first" {
+		t.Fatalf("bad token, got '%s', expected '%s'", token, "first")
+	}
+
+	if err := ioutil.WriteFile(tokenFile, []byte("second\n"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Ensure the change is visible even on filesystems with coarse timestamps.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(tokenFile, later, later); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, _, err := client.KV().Get("key", nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if token := <-tokens; token != "second" {
+		t.Fatalf("bad token, got '%s', expected '%s'", token, "second")
+	}
+}
+
+func TestConfig_GetAPIClient_CredentialsFile(t *testing.T) {
+	config := DefaultConfig()
+	config.CredentialsFile = filepath.Join(os.TempDir(), "depro-missing-credentials")
+
+	if _, err := config.GetAPIClient(); err == nil {
+		t.Fatalf("expected an error for a missing credentials file")
+	}
+
+	dir, err := ioutil.TempDir("", "depro-common")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	auth := make(chan [2]string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		auth <- [2]string{username, password}
+		w.Write([]byte("null"))
+	}))
+	defer server.Close()
+
+	config.Server = server.Listener.Addr().String()
+	config.CredentialsFile = filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(config.CredentialsFile, []byte("depro:secret:value"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	client, err := config.GetAPIClient()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, _, err := client.KV().Get("key", nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if credentials := <-auth; credentials[0] != "depro" || credentials[1] != "secret:value" {
+		t.Fatalf("bad credentials, got '%s' and '%s'", credentials[0], credentials[1])
+	}
+}
@@ -0,0 +1,294 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// DecodeJSON decodes a JSON configuration document into v, which must be a
+// pointer to a struct. It returns the names of the top-level fields present
+// in the document, any fields which do not correspond to a field of v are
+// reported as problems.
+func DecodeJSON(r io.Reader, v interface{}) ([]string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, withLine(data, err)
+	}
+
+	return decodeFields(data, v)
+}
+
+// decodeFields decodes the field names present in a JSON document which has
+// already been decoded into v.
+func decodeFields(data []byte, v interface{}) ([]string, error) {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	return FieldNames(raw, v)
+}
+
+// withLine adds the line and column at which a JSON decoding error occurred
+// to its message.
+func withLine(data []byte, err error) error {
+	var offset int64
+
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		offset = err.Offset
+	case *json.UnmarshalTypeError:
+		offset = err.Offset
+	default:
+		return err
+	}
+
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	line, column := 1, 1
+	for _, c := range data[:offset] {
+		if c == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+
+	return fmt.Errorf("line %d, column %d: %s", line, column, err)
+}
+
+// FieldNames checks a generic document, as produced by decoding into an
+// interface{}, against the fields of v. It returns the names of the top-level
+// fields present in the document and reports unknown fields as problems.
+func FieldNames(raw interface{}, v interface{}) ([]string, error) {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	present := []string{}
+	if doc, ok := raw.(map[string]interface{}); ok {
+		fields := jsonFields(t)
+		for key := range doc {
+			if field, exists := fields[strings.ToLower(key)]; exists {
+				present = append(present, field.name)
+			}
+		}
+	}
+	sort.Strings(present)
+
+	problems := Problems{}
+	for _, field := range unknownFields("", raw, t) {
+		problems = append(problems, Problem{
+			Field:   field,
+			Message: "unknown field",
+		})
+	}
+
+	return present, problems.Err()
+}
+
+type jsonField struct {
+	name string
+	t    reflect.Type
+}
+
+// jsonFields returns the fields of a struct type which can be set from JSON,
+// keyed by their lower cased names, including those of embedded structs.
+func jsonFields(t reflect.Type) map[string]jsonField {
+	fields := map[string]jsonField{}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for key, field := range jsonFields(f.Type) {
+				if _, exists := fields[key]; !exists {
+					fields[key] = field
+				}
+			}
+			continue
+		}
+
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		fields[strings.ToLower(name)] = jsonField{name: name, t: f.Type}
+	}
+
+	return fields
+}
+
+func unknownFields(path string, raw interface{}, t reflect.Type) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	unknown := []string{}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		doc, ok := raw.(map[string]interface{})
+		if !ok {
+			return unknown
+		}
+
+		keys := make([]string, 0, len(doc))
+		for key := range doc {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fields := jsonFields(t)
+		for _, key := range keys {
+			field, exists := fields[strings.ToLower(key)]
+			if !exists {
+				unknown = append(unknown, joinField(path, key))
+				continue
+			}
+
+			unknown = append(unknown, unknownFields(joinField(path, field.name), doc[key], field.t)...)
+		}
+	case reflect.Slice, reflect.Array:
+		items, ok := raw.([]interface{})
+		if !ok {
+			return unknown
+		}
+
+		for i, item := range items {
+			unknown = append(unknown, unknownFields(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+	case reflect.Map:
+		doc, ok := raw.(map[string]interface{})
+		if !ok {
+			return unknown
+		}
+
+		keys := make([]string, 0, len(doc))
+		for key := range doc {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			unknown = append(unknown, unknownFields(fmt.Sprintf("%s[%s]", path, key), doc[key], t.Elem())...)
+		}
+	}
+
+	return unknown
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// mismatchedField returns the path of the first value in a generic document
+// which cannot be decoded into the corresponding field of t, and whether
+// there was one. Values decoded by their own UnmarshalJSON are not checked.
+func mismatchedField(path string, raw interface{}, t reflect.Type) (string, bool) {
+	if raw == nil || t.Implements(unmarshalerType) || reflect.PtrTo(t).Implements(unmarshalerType) {
+		return "", false
+	}
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		doc, ok := raw.(map[string]interface{})
+		if !ok {
+			return path, true
+		}
+
+		keys := make([]string, 0, len(doc))
+		for key := range doc {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fields := jsonFields(t)
+		for _, key := range keys {
+			if field, exists := fields[strings.ToLower(key)]; exists {
+				if path, found := mismatchedField(joinField(path, field.name), doc[key], field.t); found {
+					return path, true
+				}
+			}
+		}
+	case reflect.Map:
+		doc, ok := raw.(map[string]interface{})
+		if !ok {
+			return path, true
+		}
+
+		keys := make([]string, 0, len(doc))
+		for key := range doc {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if path, found := mismatchedField(fmt.Sprintf("%s[%s]", path, key), doc[key], t.Elem()); found {
+				return path, true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		items, ok := raw.([]interface{})
+		if !ok {
+			// Byte slices are decoded from base64 strings
+			_, isString := raw.(string)
+			return path, !(isString && t.Elem().Kind() == reflect.Uint8)
+		}
+
+		for i, item := range items {
+			if path, found := mismatchedField(fmt.Sprintf("%s[%d]", path, i), item, t.Elem()); found {
+				return path, true
+			}
+		}
+	case reflect.String:
+		_, ok := raw.(string)
+		return path, !ok
+	case reflect.Bool:
+		_, ok := raw.(bool)
+		return path, !ok
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number, ok := raw.(float64)
+		return path, !ok || number != math.Trunc(number)
+	case reflect.Float32, reflect.Float64:
+		_, ok := raw.(float64)
+		return path, !ok
+	}
+
+	return "", false
+}
+
+func joinField(path, name string) string {
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
@@ -0,0 +1,186 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	FormatJSON = "json"
+	FormatHCL  = "hcl"
+	FormatYAML = "yaml"
+)
+
+// formatExtensions maps the extensions of supported configuration files to
+// their formats.
+var formatExtensions = map[string]string{
+	".json": FormatJSON,
+	".hcl":  FormatHCL,
+	".yaml": FormatYAML,
+	".yml":  FormatYAML,
+}
+
+// FormatOf returns the format of the configuration file at the given path
+// based on its extension, or an empty string if it is not supported.
+func FormatOf(path string) string {
+	return formatExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// FileFormat returns the format of the configuration file at the given path,
+// files with unrecognised extensions are treated as JSON.
+func FileFormat(path string) string {
+	format := FormatOf(path)
+	if format == "" {
+		return FormatJSON
+	}
+
+	return format
+}
+
+// Decode decodes a configuration document in the given format into v, which
+// must be a pointer to a struct. Documents are decoded using v's JSON field
+// names regardless of their format, so that every format behaves identically.
+// It returns the names of the top-level fields present in the document, any
+// fields which do not correspond to a field of v are reported as problems.
+func Decode(r io.Reader, format string, v interface{}) ([]string, error) {
+	if format == FormatJSON {
+		return DecodeJSON(r, v)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = ToJSON(data, format, v)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, withField(data, v, err)
+	}
+
+	return decodeFields(data, v)
+}
+
+// ToJSON converts a configuration document in the given format into the JSON
+// document which Decode decodes into v. Re-encoding the document as JSON
+// applies the same field names and type conversions to every format.
+func ToJSON(data []byte, format string, v interface{}) ([]byte, error) {
+	var raw interface{}
+
+	switch format {
+	case FormatJSON:
+		return data, nil
+	case FormatHCL:
+		if err := hcl.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported configuration format '%s'", format)
+	}
+
+	return json.Marshal(normalize(raw, reflect.TypeOf(v)))
+}
+
+// withField reports a decoding error in a document which was re-encoded as
+// JSON against the field whose value could not be decoded, since its offset
+// in the re-encoded document means nothing to the document's author.
+func withField(data []byte, v interface{}, err error) error {
+	typeErr, ok := err.(*json.UnmarshalTypeError)
+	if !ok {
+		return err
+	}
+
+	var raw interface{}
+	if json.Unmarshal(data, &raw) != nil {
+		return err
+	}
+
+	field, found := mismatchedField("", raw, reflect.TypeOf(v))
+	if !found {
+		return err
+	}
+
+	return Problems{{
+		Field:   field,
+		Message: fmt.Sprintf("cannot use %s as %s", typeErr.Value, typeErr.Type),
+	}}
+}
+
+// normalize converts a document decoded from HCL or YAML into the form
+// produced by decoding JSON, guided by the type it will be decoded into.
+// YAML produces maps with interface{} keys, while HCL wraps every object in
+// a list since its blocks may be repeated.
+func normalize(raw interface{}, t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch value := raw.(type) {
+	case map[interface{}]interface{}:
+		doc := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			doc[fmt.Sprintf("%v", key)] = item
+		}
+
+		return normalize(doc, t)
+	case []map[string]interface{}:
+		items := make([]interface{}, len(value))
+		for i, item := range value {
+			items[i] = item
+		}
+
+		return normalize(items, t)
+	case map[string]interface{}:
+		var fields map[string]jsonField
+		if t != nil && t.Kind() == reflect.Struct {
+			fields = jsonFields(t)
+		}
+
+		doc := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			var itemType reflect.Type
+			if field, exists := fields[strings.ToLower(key)]; exists {
+				itemType = field.t
+			} else if t != nil && t.Kind() == reflect.Map {
+				itemType = t.Elem()
+			}
+
+			doc[key] = normalize(item, itemType)
+		}
+
+		return doc
+	case []interface{}:
+		if t != nil && (t.Kind() == reflect.Struct || t.Kind() == reflect.Map) && len(value) == 1 {
+			return normalize(value[0], t)
+		}
+
+		var itemType reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			itemType = t.Elem()
+		}
+
+		items := make([]interface{}, len(value))
+		for i, item := range value {
+			items[i] = normalize(item, itemType)
+		}
+
+		return items
+	}
+
+	return raw
+}
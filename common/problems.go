@@ -0,0 +1,82 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Problem describes an issue with a configuration value, including the file
+// and field in which it was found when they are known.
+type Problem struct {
+	File    string
+	Field   string
+	Message string
+}
+
+func (p Problem) String() string {
+	location := []string{}
+	if p.File != "" {
+		location = append(location, p.File)
+	}
+
+	if p.Field != "" {
+		location = append(location, p.Field)
+	}
+
+	if len(location) == 0 {
+		return p.Message
+	}
+
+	return fmt.Sprintf("%s: %s", strings.Join(location, ": "), p.Message)
+}
+
+// Problems is a list of configuration problems which can be returned as an
+// error.
+type Problems []Problem
+
+func (p Problems) Error() string {
+	lines := make([]string, len(p))
+	for i, problem := range p {
+		lines[i] = problem.String()
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Err returns the problems as an error, or nil if there are none.
+func (p Problems) Err() error {
+	if len(p) == 0 {
+		return nil
+	}
+
+	return p
+}
+
+// InFile returns a copy of the problems with any missing file locations
+// set to the given path.
+func (p Problems) InFile(path string) Problems {
+	result := make(Problems, len(p))
+	for i, problem := range p {
+		if problem.File == "" {
+			problem.File = path
+		}
+
+		result[i] = problem
+	}
+
+	return result
+}
+
+// AsProblems converts an error into a list of problems, preserving the
+// locations of any problems it already contains.
+func AsProblems(err error) Problems {
+	if err == nil {
+		return nil
+	}
+
+	if problems, ok := err.(Problems); ok {
+		return problems
+	}
+
+	return Problems{{Message: err.Error()}}
+}
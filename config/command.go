@@ -0,0 +1,137 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/EMSSConsulting/Depro/common"
+	"github.com/mitchellh/cli"
+)
+
+// ValidateCommand is a command implementation which checks the configuration
+// used by another command for problems.
+type ValidateCommand struct {
+	UI cli.Ui
+}
+
+// Synopsis returns a short summary of the command
+func (c *ValidateCommand) Synopsis() string {
+	return "Check the configuration used by a command for problems"
+}
+
+// Help returns the help text for the config validate command
+func (c *ValidateCommand) Help() string {
+	helpText := `
+    Usage: depro config validate command [options]
+
+        Loads the configuration for an agent, deploy, query or versions
+        command exactly as the command would, and reports every problem found
+        along with the file and field in which it was found.
+
+    Options:
+
+        Accepts the same options as the command being validated, for example
+
+        depro config validate agent -config-dir=/etc/depro/
+    `
+
+	return strings.TrimSpace(helpText)
+}
+
+// Run executes the config validate command
+func (c *ValidateCommand) Run(args []string) int {
+	if len(args) == 0 {
+		c.UI.Error(c.Help())
+		return 1
+	}
+
+	_, problems, err := Load(args[0], args[1:])
+	if err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			c.UI.Error(problem.String())
+		}
+
+		c.UI.Error(fmt.Sprintf("Configuration has %d problem(s)", len(problems)))
+		return 2
+	}
+
+	c.UI.Output("Configuration is valid")
+	return 0
+}
+
+// ShowCommand is a command implementation which prints the effective
+// configuration used by another command.
+type ShowCommand struct {
+	UI cli.Ui
+}
+
+// Synopsis returns a short summary of the command
+func (c *ShowCommand) Synopsis() string {
+	return "Print the effective configuration used by a command"
+}
+
+// Help returns the help text for the config show command
+func (c *ShowCommand) Help() string {
+	helpText := `
+    Usage: depro config show command [options]
+
+        Loads the configuration for an agent, deploy, query or versions
+        command exactly as the command would, and prints each effective value
+        along with where it was set: default, env, flag or the path of a
+        config file.
+
+    Options:
+
+        Accepts the same options as the command being shown, for example
+
+        depro config show deploy -config=/etc/depro/myapp.json
+    `
+
+	return strings.TrimSpace(helpText)
+}
+
+// Run executes the config show command
+func (c *ShowCommand) Run(args []string) int {
+	if len(args) == 0 {
+		c.UI.Error(c.Help())
+		return 1
+	}
+
+	config, problems, err := Load(args[0], args[1:])
+	if err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+
+	c.UI.Output(FormatSettings(Settings(config)))
+
+	for _, problem := range problems {
+		c.UI.Warn(problem.String())
+	}
+
+	return 0
+}
+
+func init() {
+	ui := &cli.BasicUi{
+		Writer: os.Stdout,
+	}
+
+	common.RegisterCommand("config validate", func() (cli.Command, error) {
+		return &ValidateCommand{
+			UI: ui,
+		}, nil
+	})
+
+	common.RegisterCommand("config show", func() (cli.Command, error) {
+		return &ShowCommand{
+			UI: ui,
+		}, nil
+	})
+}
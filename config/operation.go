@@ -0,0 +1,206 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/EMSSConsulting/Depro/agent"
+	"github.com/EMSSConsulting/Depro/common"
+	"github.com/EMSSConsulting/Depro/deploy"
+	"github.com/EMSSConsulting/Depro/query"
+	"github.com/EMSSConsulting/Depro/versions"
+	"github.com/hashicorp/consul/api"
+)
+
+// Commands are the commands whose configuration can be inspected.
+var Commands = []string{"agent", "deploy", "query", "versions"}
+
+// secretFields are never printed in full.
+var secretFields = map[string]struct{}{
+	"password": {},
+	"token":    {},
+}
+
+// Load reads the configuration used by the named command from its arguments,
+// exactly as the command itself would, and validates it. Any problems found
+// are returned alongside whatever configuration could be loaded.
+func Load(command string, args []string) (interface{}, common.Problems, error) {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+
+	var config interface {
+		GetAPIClient() (*api.Client, error)
+	}
+
+	problems := common.Problems{}
+
+	switch command {
+	case "agent":
+		agentConfig := agent.DefaultConfig()
+		problems = append(problems, common.AsProblems(agent.ParseFlags(agentConfig, args, flags))...)
+		problems = append(problems, common.AsProblems(agent.LoadConfigKV(context.Background(), agentConfig))...)
+		problems = append(problems, common.AsProblems(agentConfig.Validate())...)
+		config = agentConfig
+	case "deploy":
+		deployConfig := deploy.DefaultConfig()
+		problems = append(problems, common.AsProblems(deploy.ParseFlags(deployConfig, args, flags))...)
+		problems = append(problems, common.AsProblems(deployConfig.Validate())...)
+		config = deployConfig
+	case "query":
+		queryConfig := query.DefaultConfig()
+		problems = append(problems, common.AsProblems(query.ParseFlags(queryConfig, args, flags))...)
+		problems = append(problems, common.AsProblems(queryConfig.Validate())...)
+		config = queryConfig
+	case "versions":
+		versionsConfig := versions.DefaultConfig()
+		problems = append(problems, common.AsProblems(versions.ParseFlags(versionsConfig, args, flags))...)
+		problems = append(problems, common.AsProblems(versionsConfig.Validate())...)
+		config = versionsConfig
+	default:
+		return nil, nil, fmt.Errorf("unknown command '%s', expected one of %s", command, strings.Join(Commands, ", "))
+	}
+
+	if _, err := config.GetAPIClient(); err != nil {
+		problems = append(problems, common.Problem{Message: err.Error()})
+	}
+
+	return config, problems, nil
+}
+
+// Setting is a single effective configuration value.
+type Setting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+// Settings flattens a configuration into the list of its effective values
+// along with where each of them was set.
+func Settings(config interface{}) []Setting {
+	v := reflect.ValueOf(config)
+
+	sources, _ := config.(interface {
+		Source(key string) string
+	})
+
+	settings := []Setting{}
+	appendSettings(&settings, "", v, func(name string) string {
+		if sources == nil {
+			return common.SourceDefault
+		}
+
+		return sources.Source(name)
+	})
+
+	return settings
+}
+
+func appendSettings(settings *[]Setting, prefix string, v reflect.Value, source func(name string) string) {
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			appendSettings(settings, prefix, v.Field(i), source)
+			continue
+		}
+
+		if tag == "-" || f.PkgPath != "" {
+			continue
+		}
+
+		name := tag
+		if name == "" {
+			name = f.Name
+		}
+
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct {
+			for j := 0; j < field.Len(); j++ {
+				item := field.Index(j).Addr()
+				appendSettings(settings, fmt.Sprintf("%s%s[%d].", prefix, name, j), item, itemSource(item))
+			}
+			continue
+		}
+
+		if field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Struct && !field.IsNil() {
+			appendSettings(settings, fmt.Sprintf("%s%s.", prefix, name), field, source)
+			continue
+		}
+
+		if field.Kind() == reflect.Map && field.Type().Elem().Kind() == reflect.Struct {
+			keys := field.MapKeys()
+			sort.Slice(keys, func(a, b int) bool {
+				return fmt.Sprint(keys[a]) < fmt.Sprint(keys[b])
+			})
+
+			for _, key := range keys {
+				item := reflect.New(field.Type().Elem())
+				item.Elem().Set(field.MapIndex(key))
+				appendSettings(settings, fmt.Sprintf("%s%s[%v].", prefix, name, key), item, itemSource(item))
+			}
+			continue
+		}
+
+		*settings = append(*settings, Setting{
+			Name:   prefix + name,
+			Value:  formatValue(name, field),
+			Source: source(name),
+		})
+	}
+}
+
+// itemSource returns the source of the values of an item in a list, which is
+// the file it was read from when it is known.
+func itemSource(item reflect.Value) func(name string) string {
+	source := common.SourceDefault
+	if file, ok := item.Interface().(interface {
+		File() string
+	}); ok && file.File() != "" {
+		source = file.File()
+	}
+
+	return func(string) string {
+		return source
+	}
+}
+
+func formatValue(name string, v reflect.Value) string {
+	if _, secret := secretFields[name]; secret && v.Kind() == reflect.String && v.String() != "" {
+		return `"********"`
+	}
+
+	value, err := json.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Sprintf("%v", v.Interface())
+	}
+
+	return string(value)
+}
+
+// FormatSettings renders settings as an aligned table.
+func FormatSettings(settings []Setting) string {
+	var output bytes.Buffer
+
+	w := tabwriter.NewWriter(&output, 0, 4, 2, ' ', 0)
+	for _, setting := range settings {
+		fmt.Fprintf(w, "%s\t= %s\t(%s)\n", setting.Name, setting.Value, setting.Source)
+	}
+	w.Flush()
+
+	return strings.TrimRight(output.String(), "\n")
+}
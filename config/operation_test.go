@@ -0,0 +1,104 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad_Agent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depro-config")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "api.json"), []byte(`{
+		"allowStale": false,
+		"deployments": [{ "id": "api", "path": "/data/deploy/api", "prefix": "api/version" }]
+	}`), 0644)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "website.json"), []byte(`{
+		"deployments": [{ "id": "api", "shell": "fish", "scripts": [] }]
+	}`), 0644)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config, problems, err := Load("agent", []string{"-name=node1", "-config-dir=" + dir})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	websitePath := filepath.Join(dir, "website.json")
+	expected := []string{
+		websitePath + ": deployments[0].scripts: unknown field",
+	}
+
+	if len(problems) == 0 || problems[0].String() != expected[0] {
+		t.Fatalf("bad problems, got:\n%s", problems)
+	}
+
+	// The unreadable file is skipped, leaving only the first deployment
+	if len(problems) != 1 {
+		t.Fatalf("bad problem count, got %d, expected %d:\n%s", len(problems), 1, problems)
+	}
+
+	sources := map[string]string{}
+	values := map[string]string{}
+	for _, setting := range Settings(config) {
+		sources[setting.Name] = setting.Source
+		values[setting.Name] = setting.Value
+	}
+
+	if sources["name"] != "flag" || values["name"] != `"node1"` {
+		t.Fatalf("bad name setting, got %s (%s)", values["name"], sources["name"])
+	}
+
+	if sources["allowStale"] != filepath.Join(dir, "api.json") || values["allowStale"] != "false" {
+		t.Fatalf("bad allowStale setting, got %s (%s)", values["allowStale"], sources["allowStale"])
+	}
+
+	if sources["wait"] != "default" {
+		t.Fatalf("bad wait source, got %s", sources["wait"])
+	}
+
+	if sources["deployments[0].id"] != filepath.Join(dir, "api.json") {
+		t.Fatalf("bad deployment source, got %s", sources["deployments[0].id"])
+	}
+}
+
+func TestLoad_Deploy(t *testing.T) {
+	_, problems, err := Load("deploy", []string{"-prefix=", "-min-ratio=0"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(problems) != 2 {
+		t.Fatalf("bad problem count, got %d, expected %d:\n%s", len(problems), 2, problems)
+	}
+}
+
+func TestLoad_Unknown(t *testing.T) {
+	_, _, err := Load("unknown", nil)
+	if err == nil {
+		t.Fatal("expected unknown command to be rejected")
+	}
+}
+
+func TestSettings_Secrets(t *testing.T) {
+	config, _, err := Load("query", []string{"-token=secret"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, setting := range Settings(config) {
+		if setting.Name == "token" && setting.Value != `"********"` {
+			t.Fatalf("expected token to be masked, got %s", setting.Value)
+		}
+	}
+}
@@ -34,9 +34,19 @@ func (c *Command) Help() string {
 
         -server=127.0.0.1:8500 HTTP address of a Consul agent in the cluster
         -prefix=deploy/myapp
-        -nodes=3
+        -nodes=3               Wait for 3 nodes instead of every registered agent
+        -min-ratio=0.9         Roll out once 90% of the registered agents are ready
+        -meta=commit=abc123    Attach metadata to the version, may be repeated
+        -meta-file=meta.json   Attach the metadata in a JSON file to the version
+        -version-pattern=^v[0-9.]+$ Regular expression the version must match
+        -selector=region=eu    Only deploy to nodes whose agents have matching tags
         -config=/etc/depro/myapp.json
 		-auth=username:password
+        -token-file=/etc/depro/token Read the Consul token from a file
+        -consistency=stale     Consistency of reads: stale, default or consistent
+        -scheme=https          Connect to Consul over TLS
+        -ca-file=/etc/depro/ca.pem
+        -cert-file=/etc/depro/client.pem -key-file=/etc/depro/client-key.pem
     `
 
 	return strings.TrimSpace(helpText)
@@ -74,7 +84,18 @@ func (c *Command) setupConfig() (string, error) {
 		return "", err
 	}
 
-	return cmdFlags.Arg(0), nil
+	err = c.config.Validate()
+	if err != nil {
+		return "", err
+	}
+
+	version := cmdFlags.Arg(0)
+	err = c.config.CheckVersion(version)
+	if err != nil {
+		return "", fmt.Errorf("Error deploying version: %s", err)
+	}
+
+	return version, nil
 }
 
 func init() {
@@ -1,14 +1,17 @@
 package deploy
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 
 	"github.com/EMSSConsulting/Depro/common"
+	"github.com/EMSSConsulting/Depro/selector"
+	"github.com/EMSSConsulting/Depro/states"
+	"github.com/EMSSConsulting/Depro/util"
 )
 
 // Config is the configuration for a deployment agent.
@@ -17,7 +20,26 @@ import (
 type Config struct {
 	common.Config
 
-	Nodes int `json:"nodes"`
+	// Nodes overrides the number of nodes which must deploy the version
+	// before it is rolled out. When it is 0 the deployment waits for every
+	// live agent registered beneath the prefix, of which MinRatio must
+	// deploy the version successfully.
+	Nodes    int     `json:"nodes"`
+	MinRatio float64 `json:"minRatio"`
+
+	// Selector limits the version to the nodes whose agents have matching
+	// tags, see the selector package. Unless Nodes is set, the version waits
+	// for every registered agent which matches it.
+	Selector string `json:"selector"`
+
+	// VersionPattern is the regular expression which the version being
+	// deployed must match, states.DefaultVersionPattern when it is empty.
+	// It should match the pattern used by the cluster's agents.
+	VersionPattern string `json:"versionPattern"`
+
+	// Meta is the metadata attached to the version being deployed, which is
+	// only set using the -meta and -meta-file flags.
+	Meta map[string]string `json:"-"`
 }
 
 // VersionPath returns the non-/ terminated path for a version key
@@ -30,8 +52,8 @@ func (c *Config) VersionPath(version string) string {
 // default values.
 func DefaultConfig() *Config {
 	config := Config{
-		Config: common.DefaultConfig(),
-		Nodes:  1,
+		Config:   common.DefaultConfig(),
+		MinRatio: 1,
 	}
 
 	LoadEnvironment(&config)
@@ -44,23 +66,63 @@ func DefaultConfig() *Config {
 func Merge(a, b *Config) {
 	common.Merge(&a.Config, &b.Config)
 
-	if b.Nodes != 0 {
+	if b.Nodes != 0 || b.IsSet("nodes") {
 		a.Nodes = b.Nodes
+		a.MergeSource(&b.Config, "nodes")
+	}
+
+	if b.MinRatio != 0 || b.IsSet("minRatio") {
+		a.MinRatio = b.MinRatio
+		a.MergeSource(&b.Config, "minRatio")
+	}
+
+	if b.Selector != "" || b.IsSet("selector") {
+		a.Selector = b.Selector
+		a.MergeSource(&b.Config, "selector")
+	}
+
+	if b.VersionPattern != "" || b.IsSet("versionPattern") {
+		a.VersionPattern = b.VersionPattern
+		a.MergeSource(&b.Config, "versionPattern")
 	}
 }
 
+// deployFlags maps the names of the flags registered by ParseFlags to the
+// values they set.
+var deployFlags = map[string][]string{
+	"nodes":           {"nodes"},
+	"min-ratio":       {"minRatio"},
+	"selector":        {"selector"},
+	"version-pattern": {"versionPattern"},
+}
+
 func ParseFlags(config *Config, args []string, flags *flag.FlagSet) error {
 
 	var configFile string
 	flags.StringVar(&configFile, "config", "", "")
 
-	flags.IntVar(&config.Nodes, "nodes", 1, "minimum number of nodes to deploy to")
+	flags.IntVar(&config.Nodes, "nodes", config.Nodes, "number of nodes to deploy to, instead of every registered agent")
+	flags.Float64Var(&config.MinRatio, "min-ratio", config.MinRatio, "fraction of the registered agents which must deploy the version")
+	flags.StringVar(&config.Selector, "selector", config.Selector, "tags which nodes must have to deploy the version, such as region=eu")
+	flags.StringVar(&config.VersionPattern, "version-pattern", config.VersionPattern, "regular expression which version IDs must match")
+
+	var metaPairs []string
+	var metaFile string
+	flags.Var((*util.AppendSliceValue)(&metaPairs), "meta", "key=value metadata to attach to the version")
+	flags.StringVar(&metaFile, "meta-file", "", "json file of metadata to attach to the version")
 
 	err := common.ParseFlags(&config.Config, args, flags)
 	if err != nil {
 		return err
 	}
 
+	err = config.readMeta(metaFile, metaPairs)
+	if err != nil {
+		return err
+	}
+
+	common.MarkFlags(&config.Config, flags, deployFlags)
+
 	if configFile != "" {
 		cFile, err := ReadConfig(configFile)
 		if err != nil {
@@ -73,14 +135,51 @@ func ParseFlags(config *Config, args []string, flags *flag.FlagSet) error {
 	return nil
 }
 
+// readMeta reads the version's metadata from a JSON file of string values,
+// if one is given, and then from key=value pairs which take precedence.
+func (c *Config) readMeta(path string, pairs []string) error {
+	if path != "" {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Error reading metadata file '%s': %s", path, err)
+		}
+
+		meta, err := states.ParseMeta(contents)
+		if err != nil {
+			return fmt.Errorf("Error reading metadata file '%s': %s", path, err)
+		}
+
+		c.addMeta(meta)
+	}
+
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Error parsing metadata '%s': expected key=value", pair)
+		}
+
+		c.addMeta(map[string]string{parts[0]: parts[1]})
+	}
+
+	return nil
+}
+
+func (c *Config) addMeta(meta map[string]string) {
+	if c.Meta == nil {
+		c.Meta = map[string]string{}
+	}
+
+	for key, value := range meta {
+		c.Meta[key] = value
+	}
+}
+
 func LoadEnvironment(config *Config) {
 
 }
 
 // ReadConfig reads a configuration file from the given path and returns it.
 func ReadConfig(path string) (*Config, error) {
-	result := DefaultConfig()
-
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("Error reading '%s': %s", path, err)
@@ -97,31 +196,97 @@ func ReadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("Error reading '%s': expected a file, but got a directory instead", path)
 	}
 
-	config, err := DecodeConfig(f)
+	config, err := DecodeConfigFormat(f, common.FileFormat(path))
 	f.Close()
 
 	if err != nil {
-		return nil, fmt.Errorf("Error decoding '%s': %s", path, err)
+		return nil, common.AsProblems(err).InFile(path)
 	}
 
-	Merge(result, config)
+	config.SetFileSource(path)
 
-	return result, nil
+	return config, nil
 }
 
-// DecodeConfig decodes a configuration file from an io.Reader stream and returns it.
+// DecodeConfig decodes a JSON configuration file from an io.Reader stream and returns it.
 func DecodeConfig(r io.Reader) (*Config, error) {
+	return DecodeConfigFormat(r, common.FormatJSON)
+}
+
+// DecodeConfigFormat decodes a configuration file in the given format from an
+// io.Reader stream and returns it.
+func DecodeConfigFormat(r io.Reader, format string) (*Config, error) {
 	var result Config
-	dec := json.NewDecoder(r)
 
-	if err := dec.Decode(&result); err != nil {
+	fields, err := common.Decode(r, format, &result)
+	if err != nil {
 		return nil, err
 	}
 
-	err := result.Finalize()
+	for _, field := range fields {
+		result.SetSource(field, common.SourceFile)
+	}
+
+	err = result.Finalize()
 	if err != nil {
 		return nil, err
 	}
 
 	return &result, nil
 }
+
+// Validate checks that the configuration can be used to perform a
+// deployment, reporting all of the problems found.
+func (c *Config) Validate() error {
+	problems := c.Config.Validate()
+
+	if strings.Trim(c.Prefix, "/") == "" {
+		problems = append(problems, common.Problem{File: c.FileOf("prefix"), Field: "prefix", Message: "is required"})
+	}
+
+	if c.Nodes < 0 {
+		problems = append(problems, common.Problem{File: c.FileOf("nodes"), Field: "nodes", Message: "must not be negative"})
+	}
+
+	if c.MinRatio <= 0 || c.MinRatio > 1 {
+		problems = append(problems, common.Problem{File: c.FileOf("minRatio"), Field: "minRatio", Message: "must be greater than 0 and at most 1"})
+	}
+
+	if _, err := selector.Parse(c.Selector); err != nil {
+		problems = append(problems, common.Problem{File: c.FileOf("selector"), Field: "selector", Message: err.Error()})
+	}
+
+	if _, err := states.CompileVersionPattern(c.VersionPattern); err != nil {
+		problems = append(problems, common.Problem{File: c.FileOf("versionPattern"), Field: "versionPattern", Message: err.Error()})
+	}
+
+	for key := range c.Meta {
+		if strings.TrimSpace(key) == "" {
+			problems = append(problems, common.Problem{Field: "meta", Message: "keys must not be empty"})
+			break
+		}
+	}
+
+	// The selector is only set with -selector, so that the nodes waited for
+	// always match the nodes which deploy the version, while the time the
+	// version was created is always set by the deployment.
+	if _, exists := c.Meta[selector.MetaKey]; exists {
+		problems = append(problems, common.Problem{Field: "meta", Message: fmt.Sprintf("'%s' is reserved, use -selector instead", selector.MetaKey)})
+	}
+
+	if _, exists := c.Meta[states.CreatedKey]; exists {
+		problems = append(problems, common.Problem{Field: "meta", Message: fmt.Sprintf("'%s' is reserved, it is set when the version is first deployed", states.CreatedKey)})
+	}
+
+	return problems.Err()
+}
+
+// CheckVersion reports why a version may not be deployed, if it may not.
+func (c *Config) CheckVersion(version string) error {
+	pattern, err := states.CompileVersionPattern(c.VersionPattern)
+	if err != nil {
+		return err
+	}
+
+	return states.ValidateVersion(version, pattern)
+}
@@ -2,6 +2,11 @@ package deploy
 
 import (
 	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
@@ -112,3 +117,130 @@ func TestVersionPath(t *testing.T) {
 		t.Fatalf("Version path not generated correctly, got '%s' but expected '%s'", conf.VersionPath("1234"), "myapp/test/version/1234")
 	}
 }
+
+func TestParseFlags_Meta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depro-deploy")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	metaFile := filepath.Join(dir, "meta.json")
+	err = ioutil.WriteFile(metaFile, []byte(`{"commit": "abc123", "build": "http://ci/1"}`), 0644)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config := DefaultConfig()
+	flags := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	err = ParseFlags(config, []string{"-meta-file", metaFile, "-meta", "commit=def456", "-meta", "notes=a=b", "1.0"}, flags)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := map[string]string{"commit": "def456", "build": "http://ci/1", "notes": "a=b"}
+	if !reflect.DeepEqual(config.Meta, expected) {
+		t.Fatalf("bad metadata, got %v, expected %v", config.Meta, expected)
+	}
+
+	config = DefaultConfig()
+	flags = flag.NewFlagSet("deploy", flag.ContinueOnError)
+	if err := ParseFlags(config, []string{"-meta", "commit", "1.0"}, flags); err == nil {
+		t.Fatal("expected metadata without a value to be rejected")
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	config := DefaultConfig()
+
+	if err := config.CheckVersion("1.0.0"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, version := range []string{"", "..", "../../etc", "v1/extra"} {
+		if err := config.CheckVersion(version); err == nil {
+			t.Fatalf("bad version '%s', expected it to be rejected", version)
+		}
+	}
+
+	config.VersionPattern = `^v[0-9.]+$`
+	if err := config.CheckVersion("1.0.0"); err == nil {
+		t.Fatalf("bad version '%s', expected it to be rejected by '%s'", "1.0.0", config.VersionPattern)
+	}
+
+	if err := config.CheckVersion("v1.0.0"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config.VersionPattern = `[`
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected an invalid version pattern to be rejected")
+	}
+}
+
+func TestParseFlags_Selector(t *testing.T) {
+	config := DefaultConfig()
+	flags := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	err := ParseFlags(config, []string{"-prefix", "apps/api", "-selector", "region=eu", "1.0"}, flags)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.Selector != "region=eu" || config.IsSet("nodes") {
+		t.Fatalf("bad selector, got '%s'", config.Selector)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config.Selector = "region"
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected an invalid selector to be rejected")
+	}
+
+	config.Selector = ""
+	config.Meta = map[string]string{"selector": "region=eu"}
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected a selector in the metadata to be rejected")
+	}
+
+	config.Meta = map[string]string{"created": "2016-01-02T03:04:05Z"}
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected a creation time in the metadata to be rejected")
+	}
+}
+
+func TestParseFlags_MinRatio(t *testing.T) {
+	config := DefaultConfig()
+	if config.Nodes != 0 || config.MinRatio != 1 {
+		t.Fatalf("bad defaults, got %d nodes and a ratio of %v", config.Nodes, config.MinRatio)
+	}
+
+	flags := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	err := ParseFlags(config, []string{"-prefix", "apps/api", "-min-ratio", "0.9", "1.0"}, flags)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.MinRatio != 0.9 || !config.IsSet("minRatio") {
+		t.Fatalf("bad min ratio, got '%v', expected '%v'", config.MinRatio, 0.9)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, ratio := range []float64{0, -0.5, 1.5} {
+		config.MinRatio = ratio
+		if err := config.Validate(); err == nil {
+			t.Fatalf("bad min ratio '%v', expected it to be rejected", ratio)
+		}
+	}
+
+	config.MinRatio = 1
+	config.Nodes = -1
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected a negative number of nodes to be rejected")
+	}
+}
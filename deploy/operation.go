@@ -3,7 +3,10 @@ package deploy
 import (
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/EMSSConsulting/Depro/selector"
+	"github.com/EMSSConsulting/Depro/states"
 	"github.com/EMSSConsulting/waiter"
 	"github.com/hashicorp/consul/api"
 	"github.com/mitchellh/cli"
@@ -26,31 +29,108 @@ func NewOperation(ui cli.Ui, config *Config, version string) Operation {
 	}
 }
 
+// writeMeta attaches the configured metadata, including the selector and the
+// time at which the version was created, to the version. A version which is
+// deployed again keeps the time at which it was first created.
+func (o *Operation) writeMeta(client *api.Client) error {
+	key := fmt.Sprintf("%s/%s", o.Config.VersionPath(o.Version), states.MetaKey)
+
+	pair, _, err := client.KV().Get(key, &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return fmt.Errorf("Version '%s' metadata could not be read: %s", o.Version, err)
+	}
+
+	meta := map[string]string{}
+	for key, value := range o.Config.Meta {
+		meta[key] = value
+	}
+
+	if o.Config.Selector != "" {
+		meta[selector.MetaKey] = o.Config.Selector
+	}
+
+	meta[states.CreatedKey] = time.Now().UTC().Format(time.RFC3339)
+	if pair != nil {
+		if existing, err := states.ParseMeta(pair.Value); err == nil && existing[states.CreatedKey] != "" {
+			meta[states.CreatedKey] = existing[states.CreatedKey]
+		}
+	}
+
+	value, err := states.EncodeMeta(meta)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.KV().Put(&api.KVPair{
+		Key:   key,
+		Value: value,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Version '%s' metadata could not be written: %s", o.Version, err)
+	}
+
+	return nil
+}
+
+// reservedKeys counts the keys beneath the version which are reserved by
+// Depro rather than holding the state of a node.
+func (o *Operation) reservedKeys(client *api.Client) (int, error) {
+	prefix := fmt.Sprintf("%s/", o.Config.VersionPath(o.Version))
+
+	keys, _, err := client.KV().Keys(prefix, "", &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return 0, err
+	}
+
+	reserved := 0
+	for _, key := range keys {
+		if states.IsReserved(strings.TrimPrefix(key, prefix)) {
+			reserved++
+		}
+	}
+
+	return reserved, nil
+}
+
 func (o *Operation) runDeployment(client *api.Client) error {
+	q, err := o.quorum(client)
+	if err != nil {
+		return err
+	}
+
+	// The waiter sees reserved keys as nodes, so they are always treated as
+	// ready and added to the number of nodes it waits for, as are the nodes
+	// which skip the version.
+	reserved, err := o.reservedKeys(client)
+	if err != nil {
+		return fmt.Errorf("Version '%s' could not be read: %s", o.Version, err)
+	}
+
 	o.wait = waiter.NewWaiter(
 		client,
 		o.Config.VersionPath(o.Version),
-		o.Config.Nodes,
+		q.Required+q.Skipping+reserved,
 		func(w *waiter.WaitNode) bool {
-			switch w.State {
-			case "ready":
-				fallthrough
-			case "available":
-				fallthrough
-			case "failed":
-				fallthrough
-			case "active":
+			if states.IsReserved(w.Node) {
 				return true
-
 			}
 
-			return false
+			return q.ready(states.ParseRecord(w.State).State)
 		})
 
 	errorCh := make(chan error)
 
+	// dropped holds the nodes which stopped reporting the version's state
+	// while it was being deployed, and failed those which failed to deploy it.
+	dropped := map[string]struct{}{}
+	failed := map[string]struct{}{}
+
 	go func() {
-		o.UI.Info(fmt.Sprintf("Starting deployment of version '%s'", o.Version))
+		if o.Config.Selector != "" {
+			o.UI.Info(fmt.Sprintf("Starting deployment of version '%s' to %s matching '%s'", o.Version, q, o.Config.Selector))
+		} else {
+			o.UI.Info(fmt.Sprintf("Starting deployment of version '%s' to %s", o.Version, q))
+		}
 		allReady, err := o.wait.Wait(o.Config.WaitTime)
 
 		if !allReady && err == nil {
@@ -68,38 +148,139 @@ func (o *Operation) runDeployment(client *api.Client) error {
 	for {
 		select {
 		case node := <-o.wait.NodeUpdate:
-			if node.State == "" && node.LastState == "" {
+			if states.IsReserved(node.Node) {
+				continue
+			}
+
+			state := states.ParseRecord(node.State).State
+			lastState := states.ParseRecord(node.LastState).State
+
+			if state == "" && lastState == "" {
 				o.UI.Info(fmt.Sprintf("+ %s", node.Node))
-			} else if node.State == "" {
-				o.UI.Info(fmt.Sprintf("- %s #%s", node.Node, node.LastState))
-			} else if node.LastState == "" {
-				o.UI.Info(fmt.Sprintf("+ %s #%s", node.Node, node.State))
+			} else if state == "" {
+				dropped[node.Node] = struct{}{}
+				o.UI.Warn(fmt.Sprintf("! %s dropped out #%s", node.Node, lastState))
+			} else if lastState == "" {
+				delete(dropped, node.Node)
+				o.UI.Info(fmt.Sprintf("+ %s #%s", node.Node, state))
+			} else if state != lastState {
+				o.UI.Info(fmt.Sprintf("> %s #%s -> #%s", node.Node, lastState, state))
+			}
+
+			if state.Failed() {
+				failed[node.Node] = struct{}{}
 			} else {
-				o.UI.Info(fmt.Sprintf("> %s #%s -> #%s", node.Node, node.LastState, node.State))
+				delete(failed, node.Node)
+			}
+
+			if q.Tolerant && len(failed) > q.Waiting-q.Required {
+				return fmt.Errorf("Version '%s' failed on more nodes than -min-ratio allows: %s", o.Version, joinNodes(failed))
 			}
 		case node := <-o.wait.NodeReady:
+			if states.IsReserved(node.Node) {
+				continue
+			}
+
+			if states.ParseRecord(node.State).State == states.Skipped {
+				o.UI.Info(fmt.Sprintf("~ %s@%s skipped", o.Version, node.Node))
+				continue
+			}
+
 			o.UI.Output(fmt.Sprintf("+ %s@%s", o.Version, node.Node))
 		case nodes := <-o.wait.AllReady:
 			successful := true
 			for _, node := range nodes {
-				if node.State == "failed" {
-					o.UI.Warn(fmt.Sprintf("! %s #failed", node.Node))
+				if states.IsReserved(node.Node) {
+					continue
+				}
+
+				record := states.ParseRecord(node.State)
+				if record.State.Failed() {
+					if reason := record.Reason(); reason != "" {
+						o.UI.Warn(fmt.Sprintf("! %s #%s (%s)", node.Node, record.State, reason))
+					} else {
+						o.UI.Warn(fmt.Sprintf("! %s #%s", node.Node, record.State))
+					}
 					successful = false
 				}
 			}
-			if successful {
-				o.UI.Info(fmt.Sprintf("Version '%s' deployed to all nodes, starting rollout.", o.Version))
-			} else {
+			if !successful {
 				return fmt.Errorf("Version '%s' deployment failed", o.Version)
 			}
 
+			if err := o.confirmReady(client, q); err != nil {
+				return err
+			}
+
+			if q.Tolerant {
+				o.UI.Info(fmt.Sprintf("Version '%s' deployed to %s, starting rollout.", o.Version, q))
+			} else {
+				o.UI.Info(fmt.Sprintf("Version '%s' deployed to all nodes, starting rollout.", o.Version))
+			}
 			return nil
 		case err := <-errorCh:
+			if len(dropped) > 0 {
+				return fmt.Errorf("%s Nodes which dropped out: %s", err, joinNodes(dropped))
+			}
+
 			return err
 		}
 	}
 }
 
+// confirmReady checks that the version has been prepared by enough nodes
+// before it is rolled out. The check always uses a consistent read, since
+// the results of the reads made while waiting for nodes may be stale.
+// Registered nodes which no longer report the version's state are reported
+// as having dropped out, and still count towards the nodes required.
+func (o *Operation) confirmReady(client *api.Client, q quorum) error {
+	prefix := o.Config.VersionPath(o.Version)
+
+	pairs, _, err := client.KV().List(prefix, &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return fmt.Errorf("Version '%s' readiness could not be confirmed: %s", o.Version, err)
+	}
+
+	ready := 0
+	reported := map[string]struct{}{}
+	for _, pair := range pairs {
+		node := strings.Trim(strings.TrimPrefix(pair.Key, prefix), "/")
+		if node == "" || states.IsReserved(node) {
+			continue
+		}
+
+		reported[node] = struct{}{}
+
+		record := states.ParseRecord(string(pair.Value))
+		if record.State.Failed() && !q.Tolerant {
+			if reason := record.Reason(); reason != "" {
+				return fmt.Errorf("Version '%s' failed on node '%s': %s", o.Version, node, reason)
+			}
+
+			return fmt.Errorf("Version '%s' failed on node '%s'", o.Version, node)
+		}
+
+		if record.State.Ready() {
+			ready++
+		}
+	}
+
+	dropped := q.missing(reported)
+	if len(dropped) > 0 {
+		o.UI.Warn(fmt.Sprintf("Nodes which dropped out of the deployment: %s", joinNodes(dropped)))
+	}
+
+	if ready < q.Required {
+		if len(dropped) > 0 {
+			return fmt.Errorf("Version '%s' is only ready on %d of %d nodes, %d dropped out", o.Version, ready, q.Required, len(dropped))
+		}
+
+		return fmt.Errorf("Version '%s' is only ready on %d of %d nodes", o.Version, ready, q.Required)
+	}
+
+	return nil
+}
+
 func (o *Operation) runRollout(client *api.Client) error {
 	kv := client.KV()
 
@@ -119,9 +300,17 @@ func (o *Operation) runRollout(client *api.Client) error {
 
 // Run executes the process for a deployment operation
 func (o *Operation) Run() error {
-	client := o.Config.GetAPIClient()
+	client, err := o.Config.GetAPIClient()
+	if err != nil {
+		return err
+	}
+
+	err = o.writeMeta(client)
+	if err != nil {
+		return err
+	}
 
-	err := o.runDeployment(client)
+	err = o.runDeployment(client)
 	if err != nil {
 		return err
 	}
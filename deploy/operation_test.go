@@ -3,10 +3,13 @@ package deploy
 import (
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/EMSSConsulting/Depro/common"
+	"github.com/EMSSConsulting/Depro/selector"
+	"github.com/EMSSConsulting/Depro/states"
 	"github.com/hashicorp/consul/api"
 	"github.com/mitchellh/cli"
 )
@@ -78,3 +81,74 @@ func TestProcess(t *testing.T) {
 
 	<-finishedCh
 }
+
+func TestMatchNodes(t *testing.T) {
+	pairs := api.KVPairs{
+		{Key: "versions/.nodes/node1", Value: []byte(`{"tags": {"region": "eu"}}`)},
+		{Key: "versions/.nodes/node2", Value: []byte(`{"tags": {"region": "us"}}`)},
+		{Key: "versions/.nodes/node3", Value: []byte(`{"tags": {"region": "eu", "tier": "canary"}}`)},
+		{Key: "versions/.nodes/node4", Value: []byte(`unreadable`)},
+	}
+
+	s, err := selector.Parse("region=eu")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	matching, skipping := matchNodes(pairs, "versions/.nodes/", s)
+	if strings.Join(matching, ",") != "node1,node3" || skipping != 2 {
+		t.Fatalf("bad nodes, got '%s' matching and %d skipping, expected '%s' and %d", strings.Join(matching, ","), skipping, "node1,node3", 2)
+	}
+}
+
+func TestRequiredNodes(t *testing.T) {
+	cases := []struct {
+		registered int
+		ratio      float64
+		expected   int
+	}{
+		{10, 1, 10},
+		{10, 0.9, 9},
+		{10, 0.85, 9},
+		{3, 0.5, 2},
+		{3, 0.01, 1},
+		{1, 0.5, 1},
+	}
+
+	for _, c := range cases {
+		if required := requiredNodes(c.registered, c.ratio); required != c.expected {
+			t.Fatalf("bad required nodes for %v of %d, got '%d', expected '%d'", c.ratio, c.registered, required, c.expected)
+		}
+	}
+}
+
+func TestQuorum_Ready(t *testing.T) {
+	strict := quorum{Waiting: 3, Required: 3}
+	tolerant := quorum{Waiting: 3, Required: 2, Tolerant: true}
+
+	cases := []struct {
+		state    states.State
+		strict   bool
+		tolerant bool
+	}{
+		{states.Deploying, false, false},
+		{states.Available, true, true},
+		{states.Skipped, true, true},
+		{states.Failed, true, false},
+	}
+
+	for _, c := range cases {
+		if strict.ready(c.state) != c.strict || tolerant.ready(c.state) != c.tolerant {
+			t.Fatalf("bad readiness of {%s}, got %v and %v, expected %v and %v", c.state, strict.ready(c.state), tolerant.ready(c.state), c.strict, c.tolerant)
+		}
+	}
+}
+
+func TestQuorum_Missing(t *testing.T) {
+	q := quorum{Nodes: []string{"node1", "node2", "node3"}}
+
+	missing := q.missing(map[string]struct{}{"node2": {}})
+	if joinNodes(missing) != "node1, node3" {
+		t.Fatalf("bad missing nodes, got '%s', expected '%s'", joinNodes(missing), "node1, node3")
+	}
+}
@@ -0,0 +1,151 @@
+package deploy
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/EMSSConsulting/Depro/selector"
+	"github.com/EMSSConsulting/Depro/states"
+	"github.com/hashicorp/consul/api"
+)
+
+// quorum describes the nodes which a deployment waits for before the version
+// is rolled out.
+type quorum struct {
+	// Nodes are the agents which were registered beneath the prefix when the
+	// deployment began and are expected to deploy the version, while
+	// Skipping is the number expected to skip it.
+	Nodes    []string
+	Skipping int
+
+	// Waiting is the number of nodes the deployment waits for, Required is
+	// the number of them which must deploy the version successfully.
+	Waiting  int
+	Required int
+
+	// Tolerant quorums allow nodes to fail or drop out, as long as enough
+	// of them deploy the version.
+	Tolerant bool
+}
+
+// String describes the nodes which the deployment waits for.
+func (q quorum) String() string {
+	if q.Tolerant {
+		return fmt.Sprintf("at least %d of %d nodes", q.Required, q.Waiting)
+	}
+
+	return fmt.Sprintf("%d nodes", q.Required)
+}
+
+// ready reports whether a node in the given state counts towards the nodes
+// waited for. Tolerant quorums only count the nodes which are ready, so that
+// the deployment finishes once enough of them are rather than waiting for the
+// nodes which failed or dropped out.
+func (q quorum) ready(state states.State) bool {
+	if q.Tolerant {
+		return state.Ready() || state == states.Skipped
+	}
+
+	return state.Settled()
+}
+
+// missing returns the registered nodes which have not reported the state of
+// the version.
+func (q quorum) missing(reported map[string]struct{}) map[string]struct{} {
+	missing := map[string]struct{}{}
+	for _, node := range q.Nodes {
+		if _, exists := reported[node]; !exists {
+			missing[node] = struct{}{}
+		}
+	}
+
+	return missing
+}
+
+// quorum decides which nodes the deployment waits for. By default it waits
+// for every live agent registered beneath the prefix whose tags match the
+// version's selector, of which -min-ratio must deploy the version, while
+// -nodes overrides the number of nodes it waits for.
+func (o *Operation) quorum(client *api.Client) (quorum, error) {
+	s, err := selector.Parse(o.Config.Selector)
+	if err != nil {
+		return quorum{}, err
+	}
+
+	prefix := fmt.Sprintf("%s/%s/", strings.Trim(o.Config.Prefix, "/"), states.NodesKey)
+	pairs, _, err := client.KV().List(prefix, &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return quorum{}, fmt.Errorf("Registered nodes could not be read: %s", err)
+	}
+
+	q := quorum{}
+	q.Nodes, q.Skipping = matchNodes(pairs, prefix, s)
+
+	switch {
+	case o.Config.Nodes > 0:
+		q.Waiting = o.Config.Nodes
+		q.Required = o.Config.Nodes
+	case len(q.Nodes) == 0 && len(s) > 0:
+		return quorum{}, fmt.Errorf("No registered nodes match the selector '%s'", s)
+	case len(q.Nodes) == 0:
+		return quorum{}, fmt.Errorf("No nodes are registered beneath '%s', use -nodes to set the number of nodes to wait for", prefix)
+	default:
+		q.Waiting = len(q.Nodes)
+		q.Required = requiredNodes(len(q.Nodes), o.Config.MinRatio)
+		q.Tolerant = q.Required < q.Waiting
+	}
+
+	return q, nil
+}
+
+// requiredNodes returns the number of nodes which make up the given ratio of
+// the registered nodes, which is always at least one.
+func requiredNodes(registered int, ratio float64) int {
+	// The ratio is rounded up, allowing for the imprecision of floats
+	required := int(math.Ceil(ratio*float64(registered) - 1e-9))
+	if required < 1 {
+		return 1
+	}
+
+	if required > registered {
+		return registered
+	}
+
+	return required
+}
+
+// matchNodes returns the names of the registered agents whose tags match a
+// selector, sorted, along with the number of agents whose tags do not.
+func matchNodes(pairs api.KVPairs, prefix string, s selector.Selector) ([]string, int) {
+	matching := []string{}
+	skipping := 0
+	for _, pair := range pairs {
+		name := strings.Trim(strings.TrimPrefix(pair.Key, prefix), "/")
+		if name == "" {
+			continue
+		}
+
+		node, err := states.ParseNode(pair.Value)
+		if err == nil && s.Matches(node.Tags) {
+			matching = append(matching, name)
+		} else {
+			skipping++
+		}
+	}
+
+	sort.Strings(matching)
+	return matching, skipping
+}
+
+// joinNodes lists a set of nodes in order.
+func joinNodes(nodes map[string]struct{}) string {
+	names := make([]string, 0, len(nodes))
+	for node := range nodes {
+		names = append(names, node)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,216 @@
+// Package ordering decides which of a deployment's versions is newer than
+// another. Version IDs are opaque strings, so the order is configurable: by
+// the index at which Consul created each version, by their semantic
+// versions, or by a timestamp in their metadata.
+package ordering
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EMSSConsulting/Depro/states"
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// Index orders versions by the index at which Consul created them, this
+	// is the default.
+	Index = "index"
+	// Semver orders versions by their IDs as semantic versions, IDs which
+	// are not semantic versions are older than any which are.
+	Semver = "semver"
+	// Timestamp orders versions by a timestamp in their metadata, given as
+	// timestamp:<key>, versions without the timestamp are older than any
+	// with it.
+	Timestamp = "timestamp"
+
+	// DefaultTimestampKey is the metadata key read by Timestamp when none is
+	// given, which holds the time at which the version was created.
+	DefaultTimestampKey = states.CreatedKey
+)
+
+// Modes are the supported orderings.
+var Modes = []string{Index, Semver, Timestamp}
+
+// Version is a version of a deployment along with the details used to order
+// it.
+type Version struct {
+	ID          string
+	CreateIndex uint64
+	Meta        map[string]string
+}
+
+// Ordering is an order in which versions may be sorted.
+type Ordering struct {
+	Mode string
+	// Key is the metadata key holding the timestamp used by Timestamp.
+	Key string
+}
+
+// Parse reads an ordering of the form index, semver, timestamp or
+// timestamp:<key>, an empty ordering is the default of Index.
+func Parse(spec string) (Ordering, error) {
+	parts := strings.SplitN(strings.TrimSpace(spec), ":", 2)
+	mode := strings.ToLower(parts[0])
+
+	switch mode {
+	case "":
+		return Ordering{Mode: Index}, nil
+	case Index, Semver:
+		if len(parts) == 2 {
+			return Ordering{}, fmt.Errorf("ordering '%s' does not accept a key", mode)
+		}
+
+		return Ordering{Mode: mode}, nil
+	case Timestamp:
+		key := DefaultTimestampKey
+		if len(parts) == 2 {
+			key = parts[1]
+		}
+
+		if key == "" {
+			return Ordering{}, fmt.Errorf("ordering '%s' requires a metadata key", spec)
+		}
+
+		return Ordering{Mode: Timestamp, Key: key}, nil
+	}
+
+	return Ordering{}, fmt.Errorf("unknown ordering '%s', expected one of %s", spec, strings.Join(Modes, ", "))
+}
+
+func (o Ordering) String() string {
+	if o.Mode == Timestamp {
+		return fmt.Sprintf("%s:%s", o.Mode, o.Key)
+	}
+
+	return o.Mode
+}
+
+// Compare returns a positive number if version a is newer than b, a
+// negative number if it is older and zero if neither is newer. Versions
+// which the ordering cannot tell apart are ordered by their create index.
+func (o Ordering) Compare(a, b Version) int {
+	switch o.Mode {
+	case Semver:
+		if c := compareSemver(a.ID, b.ID); c != 0 {
+			return c
+		}
+	case Timestamp:
+		at, aok := timestamp(a.Meta[o.Key])
+		bt, bok := timestamp(b.Meta[o.Key])
+
+		switch {
+		case aok && !bok:
+			return 1
+		case !aok && bok:
+			return -1
+		case aok && bok && !at.Equal(bt):
+			if at.After(bt) {
+				return 1
+			}
+
+			return -1
+		}
+	}
+
+	switch {
+	case a.CreateIndex > b.CreateIndex:
+		return 1
+	case a.CreateIndex < b.CreateIndex:
+		return -1
+	}
+
+	return 0
+}
+
+// Sort sorts versions newest first, versions which cannot be told apart are
+// sorted by their IDs.
+func (o Ordering) Sort(versions []Version) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		if c := o.Compare(versions[i], versions[j]); c != 0 {
+			return c > 0
+		}
+
+		return versions[i].ID > versions[j].ID
+	})
+}
+
+// timestamp reads a timestamp in RFC 3339 format or as seconds since the
+// Unix epoch.
+func timestamp(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), true
+	}
+
+	return time.Time{}, false
+}
+
+// Collect finds the versions beneath a prefix, and the current version, from
+// a recursive listing of the keys beneath it. Versions are returned in the
+// order they were first listed.
+func Collect(pairs api.KVPairs, prefix string) ([]Version, string) {
+	prefix = fmt.Sprintf("%s/", strings.Trim(prefix, "/"))
+
+	versions := []Version{}
+	positions := map[string]int{}
+	current := ""
+
+	for _, pair := range pairs {
+		if !strings.HasPrefix(pair.Key, prefix) {
+			continue
+		}
+
+		key := pair.Key[len(prefix):]
+		if key == "current" {
+			current = string(pair.Value)
+			continue
+		}
+
+		parts := strings.SplitN(key, "/", 2)
+		if parts[0] == "" || states.IsReserved(parts[0]) {
+			continue
+		}
+
+		position, exists := positions[parts[0]]
+		if !exists {
+			position = len(versions)
+			positions[parts[0]] = position
+			versions = append(versions, Version{ID: parts[0], CreateIndex: pair.CreateIndex})
+		}
+
+		version := &versions[position]
+		if pair.CreateIndex < version.CreateIndex {
+			version.CreateIndex = pair.CreateIndex
+		}
+
+		if len(parts) == 2 && parts[1] == states.MetaKey {
+			if meta, err := states.ParseMeta(pair.Value); err == nil {
+				version.Meta = meta
+			}
+		}
+	}
+
+	return versions, current
+}
+
+// IDs returns the IDs of versions, in order.
+func IDs(versions []Version) []string {
+	ids := make([]string, len(versions))
+	for i, version := range versions {
+		ids[i] = version.ID
+	}
+
+	return ids
+}
@@ -0,0 +1,144 @@
+package ordering
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EMSSConsulting/Depro/states"
+	"github.com/hashicorp/consul/api"
+)
+
+func TestParse(t *testing.T) {
+	cases := map[string]Ordering{
+		"":                Ordering{Mode: Index},
+		"index":           Ordering{Mode: Index},
+		"SemVer":          Ordering{Mode: Semver},
+		"timestamp":       Ordering{Mode: Timestamp, Key: DefaultTimestampKey},
+		"timestamp:built": Ordering{Mode: Timestamp, Key: "built"},
+	}
+
+	for spec, expected := range cases {
+		order, err := Parse(spec)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if order != expected {
+			t.Fatalf("bad ordering for '%s', got '%s', expected '%s'", spec, order, expected)
+		}
+	}
+
+	for _, spec := range []string{"newest", "semver:key", "timestamp:"} {
+		if _, err := Parse(spec); err == nil {
+			t.Fatalf("expected ordering '%s' to be rejected", spec)
+		}
+	}
+}
+
+func TestCompareSemver(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.2.0", "1.10.0", -1},
+		{"v2", "1.9.9", 1},
+		{"1.0.0-alpha", "1.0.0", -1},
+		{"1.0.0-alpha.2", "1.0.0-alpha.10", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0+build.1", "1.0.0", 0},
+		{"585ecfa", "1.0.0", -1},
+		{"585ecfa", "1e07a29", 0},
+	}
+
+	for _, c := range cases {
+		result := compareSemver(c.a, c.b)
+		if (result > 0) != (c.expected > 0) || (result < 0) != (c.expected < 0) {
+			t.Fatalf("bad comparison of '%s' and '%s', got %d, expected %d", c.a, c.b, result, c.expected)
+		}
+	}
+}
+
+func TestOrdering_Sort(t *testing.T) {
+	versions := []Version{
+		{ID: "a", CreateIndex: 30, Meta: map[string]string{"built": "2016-01-01T00:00:00Z"}},
+		{ID: "b", CreateIndex: 10, Meta: map[string]string{"built": "1451779200"}},
+		{ID: "c", CreateIndex: 20},
+	}
+
+	cases := map[string]string{
+		"index":           "a,c,b",
+		"timestamp:built": "b,a,c",
+		"semver":          "a,c,b",
+	}
+
+	for spec, expected := range cases {
+		order, _ := Parse(spec)
+		sorted := append([]Version{}, versions...)
+		order.Sort(sorted)
+
+		if ids := strings.Join(IDs(sorted), ","); ids != expected {
+			t.Fatalf("bad order for '%s', got '%s', expected '%s'", spec, ids, expected)
+		}
+	}
+}
+
+func TestOrdering_Created(t *testing.T) {
+	created := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// The metadata is written as it is when a version is deployed, with
+	// 1.1 deployed again after 1.2 had been created.
+	meta := func(created time.Time) []byte {
+		value, err := states.EncodeMeta(map[string]string{
+			states.CreatedKey: created.Format(time.RFC3339),
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		return value
+	}
+
+	pairs := api.KVPairs{
+		{Key: "apps/api/1.0/.meta", Value: meta(created), CreateIndex: 3},
+		{Key: "apps/api/1.1/.meta", Value: meta(created.Add(time.Hour)), CreateIndex: 30},
+		{Key: "apps/api/1.2/.meta", Value: meta(created.Add(2 * time.Hour)), CreateIndex: 20},
+	}
+
+	versions, _ := Collect(pairs, "apps/api")
+
+	order, err := Parse("timestamp")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	order.Sort(versions)
+
+	if ids := strings.Join(IDs(versions), ","); ids != "1.2,1.1,1.0" {
+		t.Fatalf("bad order, got '%s', expected '%s'", ids, "1.2,1.1,1.0")
+	}
+}
+
+func TestCollect(t *testing.T) {
+	pairs := api.KVPairs{
+		{Key: "apps/api/1.0/node1", Value: []byte("available"), CreateIndex: 5},
+		{Key: "apps/api/1.0/.meta", Value: []byte(`{"commit": "abc"}`), CreateIndex: 3},
+		{Key: "apps/api/1.1/node1", Value: []byte("deploying"), CreateIndex: 8},
+		{Key: "apps/api/current", Value: []byte("1.0")},
+		{Key: "apps/api/.nodes/node1", Value: []byte("{}")},
+		{Key: "apps/api2/2.0/node1", Value: []byte("available")},
+	}
+
+	versions, current := Collect(pairs, "apps/api")
+	if current != "1.0" {
+		t.Fatalf("bad current version, got '%s', expected '%s'", current, "1.0")
+	}
+
+	if ids := strings.Join(IDs(versions), ","); ids != "1.0,1.1" {
+		t.Fatalf("bad versions, got '%s', expected '%s'", ids, "1.0,1.1")
+	}
+
+	if versions[0].CreateIndex != 3 || versions[0].Meta["commit"] != "abc" {
+		t.Fatalf("bad version, got %#v", versions[0])
+	}
+}
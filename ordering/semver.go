@@ -0,0 +1,112 @@
+package ordering
+
+import (
+	"strconv"
+	"strings"
+)
+
+// compareSemver compares two version IDs as semantic versions, returning
+// a positive number if a is the higher version, a negative number if b is
+// and zero if they are equal. IDs which are not semantic versions are lower
+// than any which are, and equal to each other.
+func compareSemver(a, b string) int {
+	av, aok := parseSemver(a)
+	bv, bok := parseSemver(b)
+
+	switch {
+	case aok && !bok:
+		return 1
+	case !aok && bok:
+		return -1
+	case !aok && !bok:
+		return 0
+	}
+
+	for i := 0; i < 3; i++ {
+		if av.numbers[i] != bv.numbers[i] {
+			if av.numbers[i] > bv.numbers[i] {
+				return 1
+			}
+
+			return -1
+		}
+	}
+
+	return comparePrerelease(av.prerelease, bv.prerelease)
+}
+
+type semver struct {
+	numbers    [3]uint64
+	prerelease []string
+}
+
+// parseSemver reads a version of the form [v]major[.minor[.patch]][-pre][+build],
+// ignoring any build metadata.
+func parseSemver(id string) (semver, bool) {
+	var v semver
+
+	id = strings.TrimPrefix(strings.TrimPrefix(id, "v"), "V")
+	if i := strings.Index(id, "+"); i >= 0 {
+		id = id[:i]
+	}
+
+	if i := strings.Index(id, "-"); i >= 0 {
+		v.prerelease = strings.Split(id[i+1:], ".")
+		id = id[:i]
+	}
+
+	parts := strings.Split(id, ".")
+	if len(parts) > 3 {
+		return v, false
+	}
+
+	for i, part := range parts {
+		number, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return v, false
+		}
+
+		v.numbers[i] = number
+	}
+
+	return v, true
+}
+
+// comparePrerelease follows semantic versioning's precedence rules, under
+// which a release is higher than any of its pre-releases.
+func comparePrerelease(a, b []string) int {
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return 0
+	case len(a) == 0:
+		return 1
+	case len(b) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(a) && i < len(b); i++ {
+		an, aerr := strconv.ParseUint(a[i], 10, 64)
+		bn, berr := strconv.ParseUint(b[i], 10, 64)
+
+		switch {
+		case aerr == nil && berr == nil:
+			if an != bn {
+				if an > bn {
+					return 1
+				}
+
+				return -1
+			}
+		case aerr == nil:
+			return -1
+		case berr == nil:
+			return 1
+		default:
+			if c := strings.Compare(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+	}
+
+	return len(a) - len(b)
+}
@@ -34,8 +34,14 @@ func (c *Command) Help() string {
 
         -server=127.0.0.1:8500 HTTP address of a Consul agent in the cluster
         -prefix=deploy/myapp
+        -ordering=semver       Order of the versions: index, semver or timestamp:<key>
         -config=/etc/depro/myapp.json
 		-auth=username:password
+        -token-file=/etc/depro/token Read the Consul token from a file
+        -consistency=stale     Consistency of reads: stale, default or consistent
+        -scheme=https          Connect to Consul over TLS
+        -ca-file=/etc/depro/ca.pem
+        -cert-file=/etc/depro/client.pem -key-file=/etc/depro/client-key.pem
     `
 
 	return strings.TrimSpace(helpText)
@@ -72,6 +78,11 @@ func (c *Command) setupConfig() (string, error) {
 		return "", err
 	}
 
+	err = c.config.Validate()
+	if err != nil {
+		return "", err
+	}
+
 	return cmdFlags.Arg(0), nil
 }
 
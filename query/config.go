@@ -1,7 +1,6 @@
 package query
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -9,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/EMSSConsulting/Depro/common"
+	"github.com/EMSSConsulting/Depro/ordering"
 )
 
 // Config is the configuration for a deployment agent.
@@ -16,6 +16,10 @@ import (
 // be set using a config file.
 type Config struct {
 	common.Config
+
+	// Ordering decides the order in which versions are listed, see the
+	// ordering package.
+	Ordering string `json:"ordering"`
 }
 
 // VersionPath returns the non-/ terminated path for a version key
@@ -44,6 +48,17 @@ func LoadEnvironment(config *Config) {
 // to the first.
 func Merge(a, b *Config) {
 	common.Merge(&a.Config, &b.Config)
+
+	if b.Ordering != "" || b.IsSet("ordering") {
+		a.Ordering = b.Ordering
+		a.MergeSource(&b.Config, "ordering")
+	}
+}
+
+// queryFlags maps the names of the flags registered by ParseFlags to the
+// values they set.
+var queryFlags = map[string][]string{
+	"ordering": {"ordering"},
 }
 
 func ParseFlags(config *Config, args []string, flags *flag.FlagSet) error {
@@ -51,11 +66,15 @@ func ParseFlags(config *Config, args []string, flags *flag.FlagSet) error {
 	var configFile string
 	flags.StringVar(&configFile, "config", "", "")
 
+	flags.StringVar(&config.Ordering, "ordering", config.Ordering, "order of the versions: index, semver or timestamp:<key>")
+
 	err := common.ParseFlags(&config.Config, args, flags)
 	if err != nil {
 		return err
 	}
 
+	common.MarkFlags(&config.Config, flags, queryFlags)
+
 	if configFile != "" {
 		cFile, err := ReadConfig(configFile)
 		if err != nil {
@@ -70,8 +89,6 @@ func ParseFlags(config *Config, args []string, flags *flag.FlagSet) error {
 
 // ReadConfig reads a configuration file from the given path and returns it.
 func ReadConfig(path string) (*Config, error) {
-	result := DefaultConfig()
-
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("Error reading '%s': %s", path, err)
@@ -88,31 +105,57 @@ func ReadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("Error reading '%s': expected a file, but got a directory instead", path)
 	}
 
-	config, err := DecodeConfig(f)
+	config, err := DecodeConfigFormat(f, common.FileFormat(path))
 	f.Close()
 
 	if err != nil {
-		return nil, fmt.Errorf("Error decoding '%s': %s", path, err)
+		return nil, common.AsProblems(err).InFile(path)
 	}
 
-	Merge(result, config)
+	config.SetFileSource(path)
 
-	return result, nil
+	return config, nil
 }
 
-// DecodeConfig decodes a configuration file from an io.Reader stream and returns it.
+// DecodeConfig decodes a JSON configuration file from an io.Reader stream and returns it.
 func DecodeConfig(r io.Reader) (*Config, error) {
+	return DecodeConfigFormat(r, common.FormatJSON)
+}
+
+// DecodeConfigFormat decodes a configuration file in the given format from an
+// io.Reader stream and returns it.
+func DecodeConfigFormat(r io.Reader, format string) (*Config, error) {
 	var result Config
-	dec := json.NewDecoder(r)
 
-	if err := dec.Decode(&result); err != nil {
+	fields, err := common.Decode(r, format, &result)
+	if err != nil {
 		return nil, err
 	}
 
-	err := result.Finalize()
+	for _, field := range fields {
+		result.SetSource(field, common.SourceFile)
+	}
+
+	err = result.Finalize()
 	if err != nil {
 		return nil, err
 	}
 
 	return &result, nil
 }
+
+// Validate checks that the configuration can be used to query a
+// deployment, reporting all of the problems found.
+func (c *Config) Validate() error {
+	problems := c.Config.Validate()
+
+	if strings.Trim(c.Prefix, "/") == "" {
+		problems = append(problems, common.Problem{File: c.FileOf("prefix"), Field: "prefix", Message: "is required"})
+	}
+
+	if _, err := ordering.Parse(c.Ordering); err != nil {
+		problems = append(problems, common.Problem{File: c.FileOf("ordering"), Field: "ordering", Message: err.Error()})
+	}
+
+	return problems.Err()
+}
@@ -2,8 +2,13 @@ package query
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/EMSSConsulting/Depro/ordering"
+	"github.com/EMSSConsulting/Depro/states"
+	"github.com/hashicorp/consul/api"
 	"github.com/mitchellh/cli"
 )
 
@@ -24,10 +29,18 @@ func NewOperation(ui cli.Ui, config *Config, version string) Operation {
 
 // Run executes the process for a deployment operation
 func (o *Operation) Run() error {
-	client := o.Config.GetAPIClient()
+	client, err := o.Config.GetAPIClient()
+	if err != nil {
+		return err
+	}
+
 	kv := client.KV()
 
-	p, _, err := kv.Get(fmt.Sprintf("%s/current", strings.Trim(o.Config.Prefix, "/")), nil)
+	var p *api.KVPair
+	_, err = o.Config.Read(o.Config.QueryOptions(), func(q *api.QueryOptions) (meta *api.QueryMeta, err error) {
+		p, meta, err = kv.Get(fmt.Sprintf("%s/current", strings.Trim(o.Config.Prefix, "/")), q)
+		return meta, err
+	})
 	if err != nil {
 		return err
 	}
@@ -50,17 +63,95 @@ func (o *Operation) Run() error {
 	}
 
 	versionPrefix := fmt.Sprintf("%s/%s", o.Config.Prefix, o.Version)
-	ps, _, err := kv.List(versionPrefix, nil)
+	var ps api.KVPairs
+	_, err = o.Config.Read(o.Config.QueryOptions(), func(q *api.QueryOptions) (meta *api.QueryMeta, err error) {
+		ps, meta, err = kv.List(versionPrefix, q)
+		return meta, err
+	})
 	if err != nil {
 		return err
 	}
 
 	for _, p := range ps {
 		key := strings.Trim(p.Key[len(versionPrefix):], "/")
-		if len(key) > 1 {
-			o.UI.Output(fmt.Sprintf("%10s | %s", string(p.Value), key))
+		if key == states.MetaKey {
+			o.outputMeta(p.Value)
+		}
+	}
+
+	for _, p := range ps {
+		key := strings.Trim(p.Key[len(versionPrefix):], "/")
+		if len(key) > 1 && !states.IsReserved(key) {
+			o.UI.Output(formatRecord(key, states.ParseRecord(string(p.Value))))
+		}
+	}
+
+	return o.outputVersions(kv, currentVersion)
+}
+
+// outputVersions lists every version beneath the prefix, newest first in the
+// configured order.
+func (o *Operation) outputVersions(kv *api.KV, currentVersion string) error {
+	order, err := ordering.Parse(o.Config.Ordering)
+	if err != nil {
+		return err
+	}
+
+	var ps api.KVPairs
+	_, err = o.Config.Read(o.Config.QueryOptions(), func(q *api.QueryOptions) (meta *api.QueryMeta, err error) {
+		ps, meta, err = kv.List(fmt.Sprintf("%s/", strings.Trim(o.Config.Prefix, "/")), q)
+		return meta, err
+	})
+	if err != nil {
+		return err
+	}
+
+	versions, _ := ordering.Collect(ps, o.Config.Prefix)
+	order.Sort(versions)
+
+	o.UI.Output(fmt.Sprintf("Versions (%s)", order))
+	for _, version := range versions {
+		if version.ID == currentVersion {
+			o.UI.Output(fmt.Sprintf("  %s (active)", version.ID))
+		} else {
+			o.UI.Output(fmt.Sprintf("  %s", version.ID))
 		}
 	}
 
 	return nil
 }
+
+// formatRecord describes the state of a version on a node, including when
+// it was reached and why the version failed where the node recorded them.
+func formatRecord(node string, record states.Record) string {
+	line := fmt.Sprintf("%10s | %s", record.State, node)
+
+	if !record.Timestamp.IsZero() {
+		line = fmt.Sprintf("%s | %s", line, record.Timestamp.Local().Format(time.RFC3339))
+	}
+
+	if reason := record.Reason(); reason != "" {
+		line = fmt.Sprintf("%s | %s", line, reason)
+	}
+
+	return line
+}
+
+// outputMeta displays the metadata attached to the version, sorted by key.
+func (o *Operation) outputMeta(value []byte) {
+	meta, err := states.ParseMeta(value)
+	if err != nil {
+		o.UI.Warn(fmt.Sprintf("Version '%s' has unreadable metadata: %s", o.Version, err))
+		return
+	}
+
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		o.UI.Output(fmt.Sprintf("  %s: %s", key, meta[key]))
+	}
+}
@@ -0,0 +1,88 @@
+// Package selector limits the nodes which deploy a version to those whose
+// agents have matching tags. A selector is a comma separated list of
+// requirements, each of which is either key=value or key!=value, and a node
+// matches when it meets all of them.
+package selector
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MetaKey is the key in a version's metadata holding its selector.
+const MetaKey = "selector"
+
+// Requirement is a single condition on the value of a tag.
+type Requirement struct {
+	Key   string
+	Value string
+
+	// Negated requirements match tags which are missing or have a
+	// different value.
+	Negated bool
+}
+
+// Selector is a set of requirements, all of which must be met by the tags of
+// a node. The empty selector matches every node.
+type Selector []Requirement
+
+// Parse reads a selector such as "region=eu,tier!=canary".
+func Parse(value string) (Selector, error) {
+	selector := Selector{}
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		requirement := Requirement{}
+
+		separator := "="
+		if strings.Contains(part, "!=") {
+			separator = "!="
+			requirement.Negated = true
+		}
+
+		pair := strings.SplitN(part, separator, 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid requirement '%s', expected key=value or key!=value", part)
+		}
+
+		requirement.Key = strings.TrimSpace(pair[0])
+		requirement.Value = strings.TrimSpace(pair[1])
+		if requirement.Key == "" {
+			return nil, fmt.Errorf("invalid requirement '%s', the key must not be empty", part)
+		}
+
+		selector = append(selector, requirement)
+	}
+
+	return selector, nil
+}
+
+// Matches reports whether tags meet all of the selector's requirements.
+func (s Selector) Matches(tags map[string]string) bool {
+	for _, requirement := range s {
+		value, exists := tags[requirement.Key]
+		if (exists && value == requirement.Value) == requirement.Negated {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String returns the selector in the form read by Parse.
+func (s Selector) String() string {
+	parts := make([]string, 0, len(s))
+	for _, requirement := range s {
+		if requirement.Negated {
+			parts = append(parts, fmt.Sprintf("%s!=%s", requirement.Key, requirement.Value))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s=%s", requirement.Key, requirement.Value))
+		}
+	}
+
+	return strings.Join(parts, ",")
+}
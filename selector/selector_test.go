@@ -0,0 +1,50 @@
+package selector
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	s, err := Parse(" region=eu, tier!=canary ,")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if s.String() != "region=eu,tier!=canary" {
+		t.Fatalf("bad selector, got '%s', expected '%s'", s, "region=eu,tier!=canary")
+	}
+
+	for _, value := range []string{"region", "=eu", "region=eu,tier"} {
+		if _, err := Parse(value); err == nil {
+			t.Fatalf("bad selector '%s', expected it to be rejected", value)
+		}
+	}
+}
+
+func TestSelector_Matches(t *testing.T) {
+	cases := []struct {
+		selector string
+		tags     map[string]string
+		expected bool
+	}{
+		{"", nil, true},
+		{"region=eu", map[string]string{"region": "eu"}, true},
+		{"region=eu", map[string]string{"region": "us"}, false},
+		{"region=eu", nil, false},
+		{"tier!=canary", nil, true},
+		{"tier!=canary", map[string]string{"tier": "canary"}, false},
+		{"region=eu,tier=canary", map[string]string{"region": "eu", "tier": "canary"}, true},
+		{"region=eu,tier=canary", map[string]string{"region": "eu", "tier": "main"}, false},
+	}
+
+	for _, c := range cases {
+		s, err := Parse(c.selector)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if s.Matches(c.tags) != c.expected {
+			t.Fatalf("bad match of '%s' against %v, got %v, expected %v", c.selector, c.tags, !c.expected, c.expected)
+		}
+	}
+}
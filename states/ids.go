@@ -0,0 +1,40 @@
+package states
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultVersionPattern matches the version IDs which are accepted unless a
+// different pattern is configured.
+const DefaultVersionPattern = `^[A-Za-z0-9][A-Za-z0-9._+-]{0,127}$`
+
+// CompileVersionPattern compiles a pattern for version IDs, an empty pattern
+// is DefaultVersionPattern.
+func CompileVersionPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		pattern = DefaultVersionPattern
+	}
+
+	return regexp.Compile(pattern)
+}
+
+// ValidateVersion checks that a version ID matches the pattern and is safe
+// to use as the name of a directory. IDs which are empty, begin with a ".",
+// or contain path separators are rejected whatever the pattern allows, since
+// reserved keys and files such as MetaKey and NodesKey begin with a ".".
+func ValidateVersion(id string, pattern *regexp.Regexp) error {
+	switch {
+	case id == "":
+		return fmt.Errorf("version must not be empty")
+	case strings.HasPrefix(id, "."):
+		return fmt.Errorf("version '%s' must not begin with '.'", id)
+	case strings.ContainsAny(id, "/\\\x00"):
+		return fmt.Errorf("version '%s' must not contain path separators", id)
+	case !pattern.MatchString(id):
+		return fmt.Errorf("version '%s' does not match the pattern '%s'", id, pattern)
+	}
+
+	return nil
+}
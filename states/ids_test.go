@@ -0,0 +1,39 @@
+package states
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestValidateVersion(t *testing.T) {
+	pattern, err := CompileVersionPattern("")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	valid := []string{"1.0.0", "v1.2.3-rc.1+build.5", "585ecfabf5b41bae1db7bd566ce984d77568987d", "release_2016"}
+	for _, id := range valid {
+		if err := ValidateVersion(id, pattern); err != nil {
+			t.Fatalf("bad validation of '%s', got '%s'", id, err)
+		}
+	}
+
+	invalid := []string{"", ".", "..", "../../etc", "a/b", `..\..\windows`, ".hidden", "-rf", "with space"}
+	for _, id := range invalid {
+		if err := ValidateVersion(id, pattern); err == nil {
+			t.Fatalf("bad validation of '%s', expected an error", id)
+		}
+	}
+
+	// Path separators are rejected even when the pattern allows them
+	permissive := regexp.MustCompile(`.*`)
+	if err := ValidateVersion("../etc", permissive); err == nil {
+		t.Fatalf("bad validation of '%s', expected an error", "../etc")
+	}
+
+	for _, id := range []string{".meta", ".nodes", ".depro-state.json"} {
+		if err := ValidateVersion(id, permissive); err == nil {
+			t.Fatalf("bad validation of '%s', expected an error", id)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package states
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// MetaKey is the key beneath a version, alongside the states of its nodes,
+// holding the metadata attached to the version when it was deployed.
+const MetaKey = ".meta"
+
+// CreatedKey is the key in a version's metadata holding the time at which the
+// version was first deployed, in RFC 3339 format.
+const CreatedKey = "created"
+
+// NodesKey is the key beneath a deployment's prefix, alongside its versions,
+// under which each agent running the deployment registers itself at
+// <prefix>/.nodes/<name> for as long as it is running.
+const NodesKey = ".nodes"
+
+// Node is the registration of an agent beneath a deployment's prefix.
+type Node struct {
+	// Tags are the agent's tags, which decide the versions it deploys.
+	Tags map[string]string `json:"tags"`
+}
+
+// IsReserved reports whether a key beneath a version is reserved by Depro,
+// rather than holding the state of a node. Reserved keys begin with a dot.
+func IsReserved(node string) bool {
+	return strings.HasPrefix(node, ".")
+}
+
+// ParseMeta reads the metadata stored at a version's MetaKey.
+func ParseMeta(value []byte) (map[string]string, error) {
+	meta := map[string]string{}
+	if err := json.Unmarshal(value, &meta); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// EncodeMeta returns the value stored at a version's MetaKey.
+func EncodeMeta(meta map[string]string) ([]byte, error) {
+	return json.Marshal(meta)
+}
+
+// ParseNode reads the registration of an agent stored beneath NodesKey.
+func ParseNode(value []byte) (Node, error) {
+	var node Node
+	if err := json.Unmarshal(value, &node); err != nil {
+		return Node{}, err
+	}
+
+	return node, nil
+}
+
+// Encode returns the value stored for the agent's registration.
+func (n Node) Encode() ([]byte, error) {
+	return json.Marshal(n)
+}
@@ -0,0 +1,38 @@
+package states
+
+import "testing"
+
+func TestIsReserved(t *testing.T) {
+	cases := map[string]bool{
+		MetaKey:  true,
+		".nodes": true,
+		"node1":  false,
+		"":       false,
+	}
+
+	for key, expected := range cases {
+		if IsReserved(key) != expected {
+			t.Fatalf("bad reservation of '%s', got %t, expected %t", key, !expected, expected)
+		}
+	}
+}
+
+func TestParseNode(t *testing.T) {
+	value, err := Node{Tags: map[string]string{"region": "eu"}}.Encode()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	node, err := ParseNode(value)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if node.Tags["region"] != "eu" {
+		t.Fatalf("bad tags, got %v", node.Tags)
+	}
+
+	if _, err := ParseNode([]byte("region=eu")); err == nil {
+		t.Fatal("expected an unreadable registration to be rejected")
+	}
+}
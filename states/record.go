@@ -0,0 +1,97 @@
+package states
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Record is the value published for a version at <prefix>/<version>/<node>,
+// describing its state along with how and when it got there. Older agents
+// published only the state, which ParseRecord still understands.
+type Record struct {
+	State     State     `json:"state"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// Phase is the script set which produced the state, one of deploy,
+	// rollout or clean, and Step the script or hook within it which failed.
+	Phase    string        `json:"phase,omitempty"`
+	Step     string        `json:"step,omitempty"`
+	ExitCode *int          `json:"exitCode,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"-"`
+
+	AgentVersion string `json:"agentVersion,omitempty"`
+	Checksum     string `json:"checksum,omitempty"`
+}
+
+// recordJSON is the encoding of a Record, which writes its duration in the
+// same format as the durations in configuration files.
+type recordJSON struct {
+	Record
+	Duration string `json:"duration,omitempty"`
+}
+
+// ParseRecord reads a published value, accepting both JSON records and the
+// plain states published by older agents.
+func ParseRecord(value string) Record {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "{") {
+		return Record{State: Parse(value)}
+	}
+
+	var encoded recordJSON
+	if err := json.Unmarshal([]byte(value), &encoded); err != nil {
+		return Record{State: Parse(value)}
+	}
+
+	record := encoded.Record
+	record.State = Parse(string(record.State))
+	if encoded.Duration != "" {
+		record.Duration, _ = time.ParseDuration(encoded.Duration)
+	}
+
+	return record
+}
+
+// Encode returns the value published for the record.
+func (r Record) Encode() string {
+	encoded := recordJSON{Record: r}
+	if r.Duration > 0 {
+		encoded.Duration = r.Duration.String()
+	}
+
+	value, err := json.Marshal(encoded)
+	if err != nil {
+		return string(r.State)
+	}
+
+	return string(value)
+}
+
+// Reason describes why a version failed, or returns an empty string if the
+// record does not say.
+func (r Record) Reason() string {
+	if r.Error == "" && r.ExitCode == nil {
+		return ""
+	}
+
+	reason := r.Phase
+	if r.Step != "" {
+		reason = r.Step
+	}
+	if reason == "" {
+		reason = "failed"
+	}
+
+	if r.ExitCode != nil {
+		reason = fmt.Sprintf("%s exited with code %d", reason, *r.ExitCode)
+	}
+
+	if r.Error != "" {
+		reason = fmt.Sprintf("%s: %s", reason, r.Error)
+	}
+
+	return reason
+}
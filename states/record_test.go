@@ -0,0 +1,55 @@
+package states
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRecord_Legacy(t *testing.T) {
+	cases := map[string]State{
+		"ready":   Available,
+		"busy":    Deploying,
+		"failed":  Failed,
+		"active ": Active,
+	}
+
+	for value, expected := range cases {
+		record := ParseRecord(value)
+		if record.State != expected {
+			t.Fatalf("bad state for '%s', got '%s', expected '%s'", value, record.State, expected)
+		}
+
+		if !record.Timestamp.IsZero() {
+			t.Fatalf("bad timestamp for '%s', got '%s', expected none", value, record.Timestamp)
+		}
+	}
+}
+
+func TestRecord_Encode(t *testing.T) {
+	exitCode := 2
+	record := Record{
+		State:        Failed,
+		Timestamp:    time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		Phase:        "deploy",
+		ExitCode:     &exitCode,
+		Error:        "exit status 2",
+		Duration:     1500 * time.Millisecond,
+		AgentVersion: "1.0.0",
+		Checksum:     "sha256:abc",
+	}
+
+	value := record.Encode()
+	expected := `{"state":"failed","timestamp":"2016-01-02T03:04:05Z","phase":"deploy","exitCode":2,"error":"exit status 2","agentVersion":"1.0.0","checksum":"sha256:abc","duration":"1.5s"}`
+	if value != expected {
+		t.Fatalf("bad encoding, got '%s', expected '%s'", value, expected)
+	}
+
+	parsed := ParseRecord(value)
+	if parsed.State != Failed || parsed.Duration != record.Duration || parsed.ExitCode == nil || *parsed.ExitCode != 2 || !parsed.Timestamp.Equal(record.Timestamp) {
+		t.Fatalf("bad record, got %#v, expected %#v", parsed, record)
+	}
+
+	if reason := parsed.Reason(); reason != "deploy exited with code 2: exit status 2" {
+		t.Fatalf("bad reason, got '%s', expected '%s'", reason, "deploy exited with code 2: exit status 2")
+	}
+}
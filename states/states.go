@@ -0,0 +1,144 @@
+// Package states defines the states which an agent publishes for each of the
+// versions it knows about, at <prefix>/<version>/<node>, along with the
+// transitions allowed between them. The agent, deploy and query commands all
+// use these definitions so that they agree on what each state means.
+package states
+
+import (
+	"fmt"
+	"strings"
+)
+
+// State is the state of a version on a single node.
+type State string
+
+const (
+	// Unregistered is the state of a version which the agent has not yet
+	// published.
+	Unregistered State = "unregistered"
+	// Deploying is published while a version's deploy script is running.
+	Deploying State = "deploying"
+	// Available is published once a version has been deployed and is ready
+	// to be rolled out.
+	Available State = "available"
+	// Starting is published while a version's rollout script is running.
+	Starting State = "starting"
+	// Active is published once a version has been rolled out and is the
+	// node's current version.
+	Active State = "active"
+	// Failed is published when a version's deploy, rollout or clean script
+	// fails.
+	Failed State = "failed"
+	// Invalid is published for versions whose IDs are not accepted by the
+	// agent, which are never deployed.
+	Invalid State = "invalid"
+	// Skipped is published for versions whose selectors do not match the
+	// agent's tags, which are not deployed on the node.
+	Skipped State = "skipped"
+
+	// LegacyBusy and LegacyReady were published by older agents in place of
+	// Deploying and Available respectively.
+	LegacyBusy  State = "busy"
+	LegacyReady State = "ready"
+)
+
+// All lists every state which agents publish, in the order a version
+// usually moves through them.
+var All = []State{Unregistered, Deploying, Available, Starting, Active, Failed, Invalid, Skipped}
+
+// transitions lists the states which may follow each state. A state may
+// always be published again, so is not listed as following itself.
+var transitions = map[State][]State{
+	Unregistered: {Deploying, Available, Starting, Active, Failed, Invalid, Skipped},
+	Deploying:    {Available, Failed},
+	Available:    {Starting, Active, Failed},
+	Starting:     {Active, Failed},
+	Active:       {Available, Starting, Failed},
+	Failed:       {Deploying, Starting},
+	Invalid:      {},
+	Skipped:      {},
+}
+
+// Parse returns the state with the given value, translating the states
+// published by older agents into their current equivalents. Unknown values
+// are returned unchanged, and are reported as such by Known.
+func Parse(value string) State {
+	state := State(strings.ToLower(strings.TrimSpace(value)))
+
+	switch state {
+	case LegacyBusy:
+		return Deploying
+	case LegacyReady:
+		return Available
+	}
+
+	return state
+}
+
+// Known reports whether the state is one published by agents.
+func (s State) Known() bool {
+	_, known := transitions[s]
+	return known
+}
+
+// Settled reports whether a node has finished working on a version, whether
+// it succeeded or failed, and is waiting for something else to happen.
+func (s State) Settled() bool {
+	switch s {
+	case Available, Active, Failed, Invalid, Skipped:
+		return true
+	}
+
+	return false
+}
+
+// Ready reports whether a node has successfully deployed a version, making
+// it safe to roll the version out.
+func (s State) Ready() bool {
+	switch s {
+	case Available, Active:
+		return true
+	}
+
+	return false
+}
+
+// Failed reports whether a node has failed to deploy, roll out or clean up
+// a version, or has refused to deploy it.
+func (s State) Failed() bool {
+	return s == Failed || s == Invalid
+}
+
+// CanTransition reports whether a version in this state may move to the
+// given state.
+func (s State) CanTransition(to State) bool {
+	if s == to {
+		return s.Known()
+	}
+
+	for _, next := range transitions[s] {
+		if next == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Transition checks that a version may move from one state to another,
+// returning an error describing the problem if it may not.
+func Transition(from, to State) error {
+	if !to.Known() {
+		return fmt.Errorf("Unknown state '%s'", to)
+	}
+
+	if !from.CanTransition(to) {
+		return fmt.Errorf("Illegal transition from '%s' to '%s'", from, to)
+	}
+
+	return nil
+}
+
+func (s State) String() string {
+	return string(s)
+}
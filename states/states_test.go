@@ -0,0 +1,82 @@
+package states
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	cases := map[string]State{
+		"available":  Available,
+		" Active\n":  Active,
+		"busy":       Deploying,
+		"ready":      Available,
+		"rebuilding": State("rebuilding"),
+	}
+
+	for value, expected := range cases {
+		if state := Parse(value); state != expected {
+			t.Fatalf("bad state for '%s', got '%s', expected '%s'", value, state, expected)
+		}
+	}
+
+	if Parse("rebuilding").Known() {
+		t.Fatalf("bad state, expected 'rebuilding' to be unknown")
+	}
+}
+
+func TestState_Classification(t *testing.T) {
+	cases := []struct {
+		state   State
+		settled bool
+		ready   bool
+		failed  bool
+	}{
+		{Unregistered, false, false, false},
+		{Deploying, false, false, false},
+		{Available, true, true, false},
+		{Starting, false, false, false},
+		{Active, true, true, false},
+		{Failed, true, false, true},
+		{Invalid, true, false, true},
+		{Skipped, true, false, false},
+	}
+
+	for _, c := range cases {
+		if c.state.Settled() != c.settled || c.state.Ready() != c.ready || c.state.Failed() != c.failed {
+			t.Fatalf("bad classification of '%s', got settled=%t ready=%t failed=%t", c.state, c.state.Settled(), c.state.Ready(), c.state.Failed())
+		}
+	}
+}
+
+func TestTransition(t *testing.T) {
+	legal := [][2]State{
+		{Unregistered, Deploying},
+		{Deploying, Available},
+		{Available, Starting},
+		{Starting, Active},
+		{Active, Available},
+		{Deploying, Failed},
+		{Failed, Deploying},
+		{Active, Active},
+	}
+
+	for _, c := range legal {
+		if err := Transition(c[0], c[1]); err != nil {
+			t.Fatalf("bad transition from '%s' to '%s', got '%s'", c[0], c[1], err)
+		}
+	}
+
+	illegal := [][2]State{
+		{Deploying, Active},
+		{Starting, Available},
+		{Failed, Available},
+		{Available, Unregistered},
+		{Available, LegacyReady},
+		{Invalid, Deploying},
+		{State("rebuilding"), State("rebuilding")},
+	}
+
+	for _, c := range illegal {
+		if err := Transition(c[0], c[1]); err == nil {
+			t.Fatalf("bad transition from '%s' to '%s', expected an error", c[0], c[1])
+		}
+	}
+}
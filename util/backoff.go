@@ -0,0 +1,55 @@
+package util
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Backoff produces exponentially increasing delays between retries of a
+// failing operation, starting at Min and never exceeding Max. Each delay is
+// jittered so that clients which failed together do not retry together.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	attempts uint
+}
+
+// Next returns the delay before the next retry.
+func (b *Backoff) Next() time.Duration {
+	delay := b.Max
+	if b.attempts < 32 && b.Min<<b.attempts < b.Max {
+		delay = b.Min << b.attempts
+	}
+
+	b.attempts++
+
+	// Choosing from the upper half of the delay keeps retries spread out
+	// without ever retrying immediately.
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// Reset starts the delays again from Min, once the operation has succeeded.
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
+
+// Sleep waits for the given duration, returning false if the context is
+// cancelled first.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
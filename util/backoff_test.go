@@ -0,0 +1,25 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: 1 * time.Second, Max: 10 * time.Second}
+
+	expected := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, limit := range expected {
+		limit = limit * time.Second
+
+		delay := b.Next()
+		if delay < limit/2 || delay > limit {
+			t.Fatalf("bad delay for attempt %d, got %s, expected between %s and %s", i, delay, limit/2, limit)
+		}
+	}
+
+	b.Reset()
+	if delay := b.Next(); delay > 1*time.Second {
+		t.Fatalf("bad delay after reset, got %s, expected at most %s", delay, 1*time.Second)
+	}
+}
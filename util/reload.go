@@ -0,0 +1,37 @@
+package util
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// MakeReloadCh creates a channel which will emit whenever a SIGHUP is
+// received by the application, until the context is cancelled.
+func MakeReloadCh(ctx context.Context) <-chan struct{} {
+	resultCh := make(chan struct{})
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(signalCh)
+
+		for {
+			select {
+			case <-signalCh:
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case resultCh <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return resultCh
+}
@@ -1,46 +1,49 @@
 package util
 
 import (
+	"context"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
-// MakeShutdownCh creates a channel which will emit whenever a SIGTERM/SIGINT
-// is received by the application - this is used to close any active sessions.
-func MakeShutdownCh() <-chan struct{} {
-	resultCh := make(chan struct{})
-
-	signalCh := make(chan os.Signal, 4)
+// ShutdownContext registers a single SIGTERM/SIGINT handler and returns a
+// context which is cancelled when the first signal is received. The returned
+// channel is closed if a second signal arrives while the application is still
+// shutting down, allowing callers to abandon a graceful shutdown.
+// The stop function releases the signal handler and cancels the context.
+func ShutdownContext(parent context.Context) (context.Context, <-chan struct{}, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	forceCh := make(chan struct{})
+	stopCh := make(chan struct{})
+
+	signalCh := make(chan os.Signal, 2)
 	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+
 	go func() {
-		for {
-			<-signalCh
-			resultCh <- struct{}{}
+		select {
+		case <-signalCh:
+			cancel()
+		case <-stopCh:
+			return
 		}
-	}()
-
-	return resultCh
-}
 
-// NotShutdown returns an interator which will be closed when a shutdown request
-// is received by the application.
-func NotShutdown() <-chan struct{} {
-	signalCh := make(chan os.Signal, 4)
-	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
-
-	ch := make(chan struct{})
-
-	go func() {
-		for {
-			select {
-			case <-signalCh:
-				close(ch)
-				return
-			case ch <- struct{}{}:
-			}
+		select {
+		case <-signalCh:
+			close(forceCh)
+		case <-stopCh:
 		}
 	}()
 
-	return ch
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			signal.Stop(signalCh)
+			close(stopCh)
+			cancel()
+		})
+	}
+
+	return ctx, forceCh, stop
 }
@@ -0,0 +1,96 @@
+package versions
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/EMSSConsulting/Depro/common"
+	"github.com/mitchellh/cli"
+)
+
+// Command is a command implementation which lists the versions of a
+// deployment.
+type Command struct {
+	UI     cli.Ui
+	config *Config
+	args   []string
+}
+
+// Synopsis returns a short summary of the command
+func (c *Command) Synopsis() string {
+	return "List the versions deployed to your cluster"
+}
+
+// Help returns the help text for the versions command
+func (c *Command) Help() string {
+	helpText := `
+    Usage: depro versions [options]
+
+        Lists the versions under a prefix along with their metadata and the
+        number of nodes in each state
+
+    Options:
+
+        -server=127.0.0.1:8500 HTTP address of a Consul agent in the cluster
+        -prefix=deploy/myapp
+        -sort=age              Order of the versions: age, version or timestamp:<key>
+        -json                  Write the versions as JSON
+        -config=/etc/depro/myapp.json
+		-auth=username:password
+        -token-file=/etc/depro/token Read the Consul token from a file
+        -consistency=stale     Consistency of reads: stale, default or consistent
+        -scheme=https          Connect to Consul over TLS
+        -ca-file=/etc/depro/ca.pem
+        -cert-file=/etc/depro/client.pem -key-file=/etc/depro/client-key.pem
+    `
+
+	return strings.TrimSpace(helpText)
+}
+
+// Run executes the versions command
+func (c *Command) Run(args []string) int {
+	c.args = args
+	err := c.setupConfig()
+	if err != nil {
+		c.UI.Error(err.Error())
+		return 1
+	}
+
+	op := NewOperation(c.UI, c.config)
+
+	err = op.Run()
+	if err != nil {
+		c.UI.Error(fmt.Sprintf("Failed to list versions: %s", err.Error()))
+		return 2
+	}
+
+	return 0
+}
+
+func (c *Command) setupConfig() error {
+	c.config = DefaultConfig()
+
+	cmdFlags := flag.NewFlagSet("versions", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.UI.Output(c.Help()) }
+
+	err := ParseFlags(c.config, c.args, cmdFlags)
+	if err != nil {
+		return err
+	}
+
+	return c.config.Validate()
+}
+
+func init() {
+	ui := &cli.BasicUi{
+		Writer: os.Stdout,
+	}
+
+	common.RegisterCommand("versions", func() (cli.Command, error) {
+		return &Command{
+			UI: ui,
+		}, nil
+	})
+}
@@ -0,0 +1,187 @@
+package versions
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/EMSSConsulting/Depro/common"
+	"github.com/EMSSConsulting/Depro/ordering"
+)
+
+const (
+	// SortAge lists the newest versions first, using the index at which
+	// Consul created each of them. It is the same as ordering.Index.
+	SortAge = "age"
+	// SortVersion lists versions by their semantic version, highest first.
+	// It is the same as ordering.Semver.
+	SortVersion = "version"
+)
+
+// Config is the configuration for listing the versions of a deployment.
+// Some of it can be configured using CLI flags, but most must
+// be set using a config file.
+type Config struct {
+	common.Config
+
+	// Sort is the order in which versions are listed, either age, version
+	// or any of the orderings understood by the ordering package.
+	Sort string `json:"sort"`
+
+	// JSON writes the versions as JSON rather than as a table.
+	JSON bool `json:"json"`
+}
+
+// DefaultConfig returns a pointer to a populated Config object with sensible
+// default values.
+func DefaultConfig() *Config {
+	config := Config{
+		Config: common.DefaultConfig(),
+		Sort:   SortAge,
+	}
+
+	LoadEnvironment(&config)
+
+	return &config
+}
+
+func LoadEnvironment(config *Config) {
+
+}
+
+// Merge the second command entry into the first and return a reference
+// to the first.
+func Merge(a, b *Config) {
+	common.Merge(&a.Config, &b.Config)
+
+	if b.Sort != "" || b.IsSet("sort") {
+		a.Sort = b.Sort
+		a.MergeSource(&b.Config, "sort")
+	}
+
+	if b.JSON || b.IsSet("json") {
+		a.JSON = b.JSON
+		a.MergeSource(&b.Config, "json")
+	}
+}
+
+// versionsFlags maps the names of the flags registered by ParseFlags to the
+// values they set.
+var versionsFlags = map[string][]string{
+	"sort": {"sort"},
+	"json": {"json"},
+}
+
+func ParseFlags(config *Config, args []string, flags *flag.FlagSet) error {
+
+	var configFile string
+	flags.StringVar(&configFile, "config", "", "")
+
+	flags.StringVar(&config.Sort, "sort", config.Sort, "order of the versions: age, version or timestamp:<key>")
+	flags.BoolVar(&config.JSON, "json", config.JSON, "write the versions as json")
+
+	err := common.ParseFlags(&config.Config, args, flags)
+	if err != nil {
+		return err
+	}
+
+	common.MarkFlags(&config.Config, flags, versionsFlags)
+
+	if configFile != "" {
+		cFile, err := ReadConfig(configFile)
+		if err != nil {
+			return err
+		}
+
+		Merge(config, cFile)
+	}
+
+	return nil
+}
+
+// ReadConfig reads a configuration file from the given path and returns it.
+func ReadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading '%s': %s", path, err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error reading '%s': %s", path, err)
+	}
+
+	if fi.IsDir() {
+		f.Close()
+		return nil, fmt.Errorf("Error reading '%s': expected a file, but got a directory instead", path)
+	}
+
+	config, err := DecodeConfigFormat(f, common.FileFormat(path))
+	f.Close()
+
+	if err != nil {
+		return nil, common.AsProblems(err).InFile(path)
+	}
+
+	config.SetFileSource(path)
+
+	return config, nil
+}
+
+// DecodeConfig decodes a JSON configuration file from an io.Reader stream and returns it.
+func DecodeConfig(r io.Reader) (*Config, error) {
+	return DecodeConfigFormat(r, common.FormatJSON)
+}
+
+// DecodeConfigFormat decodes a configuration file in the given format from an
+// io.Reader stream and returns it.
+func DecodeConfigFormat(r io.Reader, format string) (*Config, error) {
+	var result Config
+
+	fields, err := common.Decode(r, format, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range fields {
+		result.SetSource(field, common.SourceFile)
+	}
+
+	err = result.Finalize()
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Validate checks that the configuration can be used to list the versions
+// of a deployment, reporting all of the problems found.
+func (c *Config) Validate() error {
+	problems := c.Config.Validate()
+
+	if strings.Trim(c.Prefix, "/") == "" {
+		problems = append(problems, common.Problem{File: c.FileOf("prefix"), Field: "prefix", Message: "is required"})
+	}
+
+	if _, err := c.Ordering(); err != nil {
+		problems = append(problems, common.Problem{File: c.FileOf("sort"), Field: "sort", Message: err.Error()})
+	}
+
+	return problems.Err()
+}
+
+// Ordering returns the order in which versions are listed.
+func (c *Config) Ordering() (ordering.Ordering, error) {
+	switch strings.ToLower(c.Sort) {
+	case SortAge:
+		return ordering.Ordering{Mode: ordering.Index}, nil
+	case SortVersion:
+		return ordering.Ordering{Mode: ordering.Semver}, nil
+	}
+
+	return ordering.Parse(c.Sort)
+}
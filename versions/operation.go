@@ -0,0 +1,205 @@
+package versions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/EMSSConsulting/Depro/ordering"
+	"github.com/EMSSConsulting/Depro/states"
+	"github.com/hashicorp/consul/api"
+	"github.com/mitchellh/cli"
+)
+
+// Operation contains the configuration and clients for listing the versions
+// of a deployment.
+type Operation struct {
+	UI     cli.Ui
+	Config *Config
+}
+
+func NewOperation(ui cli.Ui, config *Config) Operation {
+	return Operation{
+		Config: config,
+		UI:     ui,
+	}
+}
+
+// Summary describes a version of a deployment and the nodes which have
+// reported their state for it.
+type Summary struct {
+	Version string `json:"version"`
+
+	// CreateIndex is the Consul index at which the first of the version's
+	// keys was created, while Created is the time at which the version was
+	// first deployed, if it was recorded in its metadata.
+	CreateIndex uint64     `json:"createIndex"`
+	Created     *time.Time `json:"created,omitempty"`
+
+	// Status is "current" for the current version, "previous" for the
+	// version before it and empty for every other version.
+	Status string `json:"status,omitempty"`
+
+	Nodes    int               `json:"nodes"`
+	States   map[string]int    `json:"states"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Run executes the process for listing versions
+func (o *Operation) Run() error {
+	client, err := o.Config.GetAPIClient()
+	if err != nil {
+		return err
+	}
+
+	prefix := strings.Trim(o.Config.Prefix, "/")
+
+	var pairs api.KVPairs
+	_, err = o.Config.Read(o.Config.QueryOptions(), func(q *api.QueryOptions) (meta *api.QueryMeta, err error) {
+		pairs, meta, err = client.KV().List(fmt.Sprintf("%s/", prefix), q)
+		return meta, err
+	})
+	if err != nil {
+		return err
+	}
+
+	order, err := o.Config.Ordering()
+	if err != nil {
+		return err
+	}
+
+	summaries := Summarize(pairs, prefix, order)
+
+	if o.Config.JSON {
+		output, err := json.MarshalIndent(summaries, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		o.UI.Output(string(output))
+		return nil
+	}
+
+	if len(summaries) == 0 {
+		o.UI.Warn("No versions have been deployed to your cluster, or you specified an incorrect prefix.")
+		return nil
+	}
+
+	o.UI.Output(FormatSummaries(summaries))
+	return nil
+}
+
+// Summarize describes each of the versions found beneath a prefix, listed
+// newest first in the given order.
+func Summarize(pairs api.KVPairs, prefix string, order ordering.Ordering) []*Summary {
+	versions, current := ordering.Collect(pairs, prefix)
+	order.Sort(versions)
+
+	list := make([]*Summary, len(versions))
+	summaries := map[string]*Summary{}
+
+	for i, version := range versions {
+		list[i] = &Summary{
+			Version:     version.ID,
+			CreateIndex: version.CreateIndex,
+			States:      map[string]int{},
+			Metadata:    version.Meta,
+		}
+		summaries[version.ID] = list[i]
+
+		if created, err := time.Parse(time.RFC3339, version.Meta[states.CreatedKey]); err == nil {
+			list[i].Created = &created
+		}
+	}
+
+	// The previous version is the one before the current version in the
+	// chosen order, which is the one a rollback would return to.
+	for i, summary := range list {
+		if summary.Version != current {
+			continue
+		}
+
+		summary.Status = "current"
+		if i+1 < len(list) {
+			list[i+1].Status = "previous"
+		}
+	}
+
+	prefix = fmt.Sprintf("%s/", strings.Trim(prefix, "/"))
+	for _, pair := range pairs {
+		parts := strings.SplitN(strings.TrimPrefix(pair.Key, prefix), "/", 2)
+		summary, exists := summaries[parts[0]]
+		if !exists || len(parts) < 2 || parts[1] == "" || states.IsReserved(parts[1]) {
+			continue
+		}
+
+		record := states.ParseRecord(string(pair.Value))
+		summary.Nodes++
+		summary.States[string(record.State)]++
+	}
+
+	return list
+}
+
+// FormatSummaries lays versions out as a table.
+func FormatSummaries(summaries []*Summary) string {
+	var output bytes.Buffer
+
+	w := tabwriter.NewWriter(&output, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "VERSION\tSTATUS\tINDEX\tCREATED\tNODES\tSTATES\tMETADATA\n")
+
+	for _, summary := range summaries {
+		created := "-"
+		if summary.Created != nil {
+			created = summary.Created.Local().Format(time.RFC3339)
+		}
+
+		status := summary.Status
+		if status == "" {
+			status = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\t%s\n",
+			summary.Version, status, summary.CreateIndex, created, summary.Nodes,
+			formatStates(summary.States), formatMeta(summary.Metadata))
+	}
+	w.Flush()
+
+	return strings.TrimRight(output.String(), "\n")
+}
+
+func formatStates(counts map[string]int) string {
+	pairs := []string{}
+	for state, count := range counts {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", state, count))
+	}
+
+	return joinPairs(pairs)
+}
+
+func formatMeta(meta map[string]string) string {
+	pairs := []string{}
+	for key, value := range meta {
+		// The creation time has its own column
+		if key == states.CreatedKey {
+			continue
+		}
+
+		pairs = append(pairs, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	return joinPairs(pairs)
+}
+
+func joinPairs(pairs []string) string {
+	if len(pairs) == 0 {
+		return "-"
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,65 @@
+package versions
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/EMSSConsulting/Depro/ordering"
+	"github.com/hashicorp/consul/api"
+)
+
+func testPairs() api.KVPairs {
+	return api.KVPairs{
+		{Key: "apps/api/current", Value: []byte("1.10.0"), CreateIndex: 1},
+		{Key: "apps/api/1.2.0/.meta", Value: []byte(`{"commit": "abc123"}`), CreateIndex: 10},
+		{Key: "apps/api/1.2.0/node1", Value: []byte("available"), CreateIndex: 11},
+		{Key: "apps/api/1.10.0/.meta", Value: []byte(`{"created": "2016-01-02T03:04:05Z"}`), CreateIndex: 20},
+		{Key: "apps/api/1.10.0/node1", Value: []byte(`{"state": "active", "timestamp": "2017-01-02T03:04:05Z"}`), CreateIndex: 21},
+		{Key: "apps/api/1.10.0/node2", Value: []byte("failed"), CreateIndex: 22},
+		{Key: "apps/api/1.10.0-rc.1/node1", Value: []byte("available"), CreateIndex: 30},
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	summaries := Summarize(testPairs(), "apps/api", ordering.Ordering{Mode: ordering.Index})
+
+	versions := []string{}
+	for _, summary := range summaries {
+		versions = append(versions, summary.Version)
+	}
+
+	if strings.Join(versions, ",") != "1.10.0-rc.1,1.10.0,1.2.0" {
+		t.Fatalf("bad versions, got '%s', expected '%s'", strings.Join(versions, ","), "1.10.0-rc.1,1.10.0,1.2.0")
+	}
+
+	current := summaries[1]
+	if current.Status != "current" || current.Nodes != 2 || current.States["active"] != 1 || current.States["failed"] != 1 {
+		t.Fatalf("bad current version, got %#v", current)
+	}
+
+	if current.Created == nil || current.Created.Year() != 2016 {
+		t.Fatalf("bad created time, got %v", current.Created)
+	}
+
+	if summaries[2].Created != nil {
+		t.Fatalf("bad created time, got %v, expected none", summaries[2].Created)
+	}
+
+	previous := summaries[2]
+	if previous.Status != "previous" || previous.Nodes != 1 || previous.Metadata["commit"] != "abc123" || previous.CreateIndex != 10 {
+		t.Fatalf("bad previous version, got %#v", previous)
+	}
+}
+
+func TestSummarize_SortVersion(t *testing.T) {
+	summaries := Summarize(testPairs(), "apps/api", ordering.Ordering{Mode: ordering.Semver})
+
+	versions := []string{}
+	for _, summary := range summaries {
+		versions = append(versions, summary.Version)
+	}
+
+	if strings.Join(versions, ",") != "1.10.0,1.10.0-rc.1,1.2.0" {
+		t.Fatalf("bad versions, got '%s', expected '%s'", strings.Join(versions, ","), "1.10.0,1.10.0-rc.1,1.2.0")
+	}
+}